@@ -21,8 +21,10 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/util/wait"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/cloud-provider/app"
@@ -38,7 +40,7 @@ import (
 
 	// For existing cloud providers, the option to import legacy providers is still available.
 	// e.g. _"k8s.io/legacy-cloud-providers/<provider>"
-	_ "github.com/mback2k/nc-failover-ccm/nc"
+	"github.com/mback2k/nc-failover-ccm/nc"
 )
 
 func main() {
@@ -48,7 +50,21 @@ func main() {
 	}
 
 	fss := cliflag.NamedFlagSets{}
-	command := app.NewCloudControllerManagerCommand(ccmOptions, cloudInitializer, app.DefaultInitFuncConstructors, names.CCMControllerAliases(), fss, wait.NeverStop)
+	validateConfig := fss.FlagSet("nc").Bool("validate-config", false, "Validate the file given by --cloud-config and exit.")
+	command := app.NewCloudControllerManagerCommand(ccmOptions, cloudInitializer, nc.InitFuncConstructors(app.DefaultInitFuncConstructors), names.CCMControllerAliases(), fss, wait.NeverStop)
+	command.AddCommand(nc.NewFailoverCommand())
+	run := command.RunE
+	command.RunE = func(cmd *cobra.Command, args []string) error {
+		if !*validateConfig {
+			return run(cmd, args)
+		}
+		cloudConfigFile := ccmOptions.KubeCloudShared.CloudProvider.CloudConfigFile
+		if err := nc.ValidateConfigFile(cloudConfigFile); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Cloud config %s is valid\n", cloudConfigFile)
+		return nil
+	}
 	code := cli.Run(command)
 	os.Exit(code)
 }
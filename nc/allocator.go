@@ -0,0 +1,206 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// allocator tracks which service owns which failover IP. The ownership is
+// persisted as service annotation and rebuilt from the cluster on first use.
+type allocator struct {
+	mutex  sync.Mutex
+	synced bool
+	owners map[netip.Addr]string
+}
+
+func newAllocator() *allocator {
+	return &allocator{owners: make(map[netip.Addr]string)}
+}
+
+func serviceKey(service *v1.Service) string {
+	return service.Namespace + "/" + service.Name
+}
+
+func (a *allocator) sync(ctx context.Context, client kubernetes.Interface) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.synced {
+		return nil
+	}
+	services, err := client.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, service := range services.Items {
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		key := serviceKey(&service)
+		addrs, err := allocatedIPs(&service)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if owner, ok := a.owners[addr]; ok && owner != key {
+				klog.Warningf("Failover IP '%s' is allocated to both service '%s' and '%s'", addr, owner, key)
+				continue
+			}
+			klog.Infof("Restored allocation of failover IP '%s' to service '%s'", addr, key)
+			a.owners[addr] = key
+		}
+	}
+	a.synced = true
+	return nil
+}
+
+// allocatedIPs returns the failover IPs persisted on a service. Services
+// managed before allocations were persisted fall back to their status.
+func allocatedIPs(service *v1.Service) ([]netip.Addr, error) {
+	addrs := []netip.Addr{}
+	if value, ok := service.Annotations[serviceAllocated]; ok {
+		for ip := range strings.SplitSeq(value, ",") {
+			if ip == "" {
+				continue
+			}
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allocated IP for service '%s': %w", service.Name, err)
+			}
+			addrs = append(addrs, addr)
+		}
+	} else if _, ok := service.Labels[serviceNode]; ok {
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			addr, err := netip.ParseAddr(ingress.IP)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// isAvailable reports whether the address is unallocated or already
+// allocated to the given service.
+func (a *allocator) isAvailable(key string, addr netip.Addr) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	owner, ok := a.owners[addr]
+	return !ok || owner == key
+}
+
+// next returns the address of the prefix already allocated to the given
+// service or else the first unallocated address of the prefix.
+func (a *allocator) next(key string, prefix netip.Prefix) (netip.Addr, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for addr, owner := range a.owners {
+		if owner == key && prefix.Contains(addr) {
+			return addr, true
+		}
+	}
+	for addr := prefix.Masked().Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+		if _, ok := a.owners[addr]; !ok {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// owns reports whether the address is allocated to the given service.
+func (a *allocator) owns(key string, addr netip.Addr) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	owner, ok := a.owners[addr]
+	return ok && owner == key
+}
+
+// tenants returns the other services owning an address of the prefix.
+func (a *allocator) tenants(key string, prefix netip.Prefix) []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	tenants := []string{}
+	for addr, owner := range a.owners {
+		if owner != key && prefix.Contains(addr) && !slices.Contains(tenants, owner) {
+			tenants = append(tenants, owner)
+		}
+	}
+	slices.Sort(tenants)
+	return tenants
+}
+
+// claim allocates the address to the given service unless it is owned by
+// another one. It reports whether the address was newly allocated.
+func (a *allocator) claim(key string, addr netip.Addr) (bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	owner, ok := a.owners[addr]
+	if ok && owner != key {
+		return false, fmt.Errorf("failover IP '%s' is already allocated to service '%s'", addr, owner)
+	}
+	a.owners[addr] = key
+	return !ok, nil
+}
+
+// assign allocates exactly the given addresses to the service, releasing
+// any other address it owned before. Nothing changes if one of the
+// addresses is owned by another service.
+func (a *allocator) assign(key string, addrs []netip.Addr) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, addr := range addrs {
+		if owner, ok := a.owners[addr]; ok && owner != key {
+			return fmt.Errorf("failover IP '%s' is already allocated to service '%s'", addr, owner)
+		}
+	}
+	for addr, owner := range a.owners {
+		if owner == key {
+			delete(a.owners, addr)
+		}
+	}
+	for _, addr := range addrs {
+		a.owners[addr] = key
+	}
+	return nil
+}
+
+// release frees the given addresses of the service, or all of them if
+// none are given.
+func (a *allocator) release(key string, addrs ...netip.Addr) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for addr, owner := range a.owners {
+		if owner != key {
+			continue
+		}
+		if len(addrs) == 0 || slices.Contains(addrs, addr) {
+			klog.Infof("Released failover IP '%s' of service '%s'", addr, key)
+			delete(a.owners, addr)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type failoverCommand struct {
+	cloudConfig string
+	kubeconfig  string
+	yes         bool
+}
+
+// NewFailoverCommand returns a command to inspect and move failover IPs by
+// hand, using the same cloud config as the cloud controller manager.
+func NewFailoverCommand() *cobra.Command {
+	f := &failoverCommand{}
+	cmd := &cobra.Command{
+		Use:   "failover",
+		Short: "Inspect and move failover IPs",
+	}
+	cmd.PersistentFlags().StringVar(&f.cloudConfig, "cloud-config", "", "Path to the cloud provider configuration file.")
+	cmd.PersistentFlags().StringVar(&f.kubeconfig, "kubeconfig", "", "Path to a kubeconfig file to read the referenced ConfigMap and Secret.")
+	cmd.MarkPersistentFlagRequired("cloud-config")
+	/* do not inherit the help of the cloud controller manager command */
+	defaults := &cobra.Command{}
+	cmd.SetHelpFunc(defaults.HelpFunc())
+	cmd.SetUsageFunc(defaults.UsageFunc())
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "servers",
+		Short: "List vServers and their state",
+		Args:  cobra.NoArgs,
+		RunE:  f.servers,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "server NAME",
+		Short: "Show interfaces and IPs of a vServer",
+		Args:  cobra.ExactArgs(1),
+		RunE:  f.server,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "owners",
+		Short: "Show the vServer each configured failover IP is routed to",
+		Args:  cobra.NoArgs,
+		RunE:  f.owners,
+	})
+	route := &cobra.Command{
+		Use:   "route IP NAME",
+		Short: "Route a configured failover IP to a vServer",
+		Args:  cobra.ExactArgs(2),
+		RunE:  f.route,
+	}
+	route.Flags().BoolVarP(&f.yes, "yes", "y", false, "Do not ask for confirmation.")
+	cmd.AddCommand(route)
+	return cmd
+}
+
+func (f *failoverCommand) connect(ctx context.Context) (*cloud, error) {
+	file, err := os.Open(f.cloudConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	provider, err := newCloud(file)
+	if err != nil {
+		return nil, err
+	}
+	c := provider.(*cloud)
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = f.kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err == nil {
+		c.client, err = kubernetes.NewForConfig(config)
+	}
+	/* the cluster is only needed to read the referenced ConfigMap and Secret */
+	if err != nil && (!c.config().Config.IsZero() || !c.config().Secret.IsZero()) {
+		return nil, err
+	}
+
+	err = c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (f *failoverCommand) servers(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	c, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := c.getServers(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE")
+	for _, name := range resp.Return_ {
+		state, err := c.getServerState(ctx, *name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\n", *name, state.Return_)
+	}
+	return w.Flush()
+}
+
+func (f *failoverCommand) server(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	c, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := c.getServerInfo(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", resp.Return_.VServerName)
+	fmt.Fprintf(w, "Status:\t%s\n", resp.Return_.Status)
+	fmt.Fprintf(w, "IPs:\t%s\n", joinIPs(resp.Return_.Ips))
+	for _, iface := range resp.Return_.ServerInterfaces {
+		fmt.Fprintf(w, "Interface:\t%s\n", iface.Mac)
+		fmt.Fprintf(w, "  IPv4:\t%s\n", joinIPs(iface.Ipv4IP))
+		fmt.Fprintf(w, "  IPv6:\t%s\n", joinIPs(iface.Ipv6IP))
+	}
+	return w.Flush()
+}
+
+func (f *failoverCommand) owners(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	c, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	config := c.config()
+	owners, err := c.ipOwners(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FAILOVER\tPOOL\tOWNER")
+	for _, prefix := range config.prefixes {
+		owner, ok := owners[prefix]
+		if !ok {
+			owner = "<none>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", prefix, config.poolOf(prefix), owner)
+	}
+	return w.Flush()
+}
+
+func (f *failoverCommand) route(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	c, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	config := c.config()
+	prefix, err := parseServerIP(args[0])
+	if err != nil {
+		return err
+	}
+	/* the whole configured prefix is routed */
+	prefix, ok := config.prefixOf(prefix.Addr())
+	if !ok {
+		return fmt.Errorf("'%s' is not a configured failover IP", args[0])
+	}
+
+	resp, err := c.getServerInfo(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	iface := publicInterface(resp.Return_)
+	if iface == nil {
+		return fmt.Errorf("vServer '%s' has no public interface", args[1])
+	}
+
+	if !f.yes {
+		fmt.Fprintf(cmd.OutOrStdout(), "Route failover IP '%s' to interface '%s' of vServer '%s'? [y/N] ", prefix, iface.Mac, resp.Return_.VServerName)
+		answer, _ := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			return errors.New("aborted")
+		}
+	}
+	route, err := c.routeServerIP(ctx, prefix.Addr().String(), strconv.Itoa(prefix.Bits()), resp.Return_.VServerName, iface.Mac)
+	if err != nil {
+		return err
+	}
+	if !route.Return_ {
+		return ErrRouteRefused
+	}
+	if config.DryRun {
+		fmt.Fprintf(cmd.OutOrStdout(), "Would route failover IP '%s' to vServer '%s' (dry-run)\n", prefix, resp.Return_.VServerName)
+		return nil
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Routed failover IP '%s' to vServer '%s'\n", prefix, resp.Return_.VServerName)
+	return nil
+}
+
+func joinIPs(ips []*string) string {
+	values := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		values = append(values, *ip)
+	}
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runFailoverCommand(t *testing.T, config string, input string, args ...string) (string, error) {
+	t.Helper()
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing"))
+	path := filepath.Join(t.TempDir(), "ccm.yaml")
+	err := os.WriteFile(path, []byte(config), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cmd := NewFailoverCommand()
+	cmd.SetArgs(append(args, "--cloud-config", path))
+	cmd.SetIn(strings.NewReader(input))
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	err = cmd.Execute()
+	return out.String(), err
+}
+
+func TestFailoverCommandRoute(t *testing.T) {
+	_, server := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}})
+	config := fmt.Sprintf("username: %s\npassword: %s\nendpoint:\n  url: %s\nfailover: [203.0.113.10/32]\n",
+		testUsername, testPassword, server.URL)
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+
+	_, err := runFailoverCommand(t, config, "n\n", "route", "203.0.113.10", "node-b")
+	if err == nil {
+		t.Error("expected route to be aborted")
+	}
+	if owner := server.Owner(prefix); owner != "" {
+		t.Errorf("failover IP routed to '%s' without confirmation", owner)
+	}
+
+	out, err := runFailoverCommand(t, config+"dryRun: true\n", "", "route", "203.0.113.10", "node-b", "--yes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := server.Owner(prefix); owner != "" {
+		t.Errorf("failover IP routed to '%s' in dry-run mode", owner)
+	}
+	if strings.Contains(out, "Routed") || !strings.Contains(out, "dry-run") {
+		t.Errorf("unexpected dry-run route output:\n%s", out)
+	}
+
+	_, err = runFailoverCommand(t, config, "", "route", "203.0.113.10", "node-b", "--yes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := server.Owner(prefix); owner != "node-b" {
+		t.Errorf("failover IP routed to '%s', want 'node-b'", owner)
+	}
+
+	out, err = runFailoverCommand(t, config, "", "owners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "203.0.113.10/32") || !strings.Contains(out, "node-b") {
+		t.Errorf("unexpected owners output:\n%s", out)
+	}
+}
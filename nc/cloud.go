@@ -19,15 +19,22 @@ package nc
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/carlmjohnson/versioninfo"
-	"github.com/hooklift/gowsdl/soap"
 	"github.com/mback2k/nc-failover-ccm/nc/scp"
-	"gopkg.in/yaml.v3"
 
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
 )
 
 const (
@@ -37,25 +44,161 @@ const (
 	xmlNS = "http://enduser.service.web.vcp.netcup.de/"
 )
 
+var ErrNotInitialized = errors.New("cloud provider not initialized")
+
 type cloud struct {
-	config *Config
-	client kubernetes.Interface
-	server scp.WSEndUser
+	base      Config
+	current   atomic.Pointer[Config]
+	client    kubernetes.Interface
+	server    scp.WSEndUser
+	uncached  *scpClient
+	alloc     *allocator
+	services  keyedMutex
+	subnets   keyedMutex
+	unhealthy unhealthyNodes
+	nodes     nodeSelector
+	events    record.EventRecorder
+	ready     atomic.Bool
+	startErr  atomic.Pointer[error]
+	logins    *credentialChecker
 }
 
+// Initialize returns right away and initializes the cloud provider in the
+// background, retrying with backoff until the referenced ConfigMap and
+// Secret could be read and SCP accepted the login. Until then, /healthz
+// reports the cloud provider as not ready.
 func (c *cloud) Initialize(ccb cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
 	c.client = ccb.ClientOrDie(providerName + "/" + versioninfo.Short())
+	c.events = newEventRecorder(c.client, stop)
+
+	go c.start(wait.ContextForChannel(stop))
+}
+
+func (c *cloud) start(ctx context.Context) {
+	backoff := wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      2 * time.Minute,
+	}
+	for {
+		err := c.initialize(ctx)
+		if err == nil {
+			break
+		}
+		c.startErr.Store(&err)
+		delay := backoff.Step()
+		klog.Errorf("Failed to initialize cloud provider, retrying in %s: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+	klog.Infof("Cloud provider initialized")
+
+	go newEndpointsController(c).Run(ctx)
+	go newDrainController(c).Run(ctx)
+	go newReloadController(c).Run(ctx)
+	go c.logins.Run(ctx)
+
+	if c.config().DryRun {
+		klog.Warning("Running in dry-run mode, failover IPs, nodes and services will not be changed")
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go func(stop <-chan struct{}) { <-stop; cancel() }(stop)
-	defer cancel()
+	if c.config().Health.Enabled {
+		go newHealthController(c).Run(ctx)
+	}
+	if c.config().Drift.Enabled {
+		go newDriftController(c).Run(ctx)
+	}
+}
 
-	err := c.config.Initialize(ctx, c.client)
+// initialize connects to SCP, verifies the login of all accounts and marks
+// the cloud provider as ready.
+func (c *cloud) initialize(ctx context.Context) error {
+	err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.login(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	c.nodes, err = newNodeSelector(&c.config().Nodes, c.client)
+	if err != nil {
+		return err
+	}
+	c.ready.Store(true)
+	return nil
+}
 
-	c.server = scp.NewWSEndUser(soap.NewClient(scpWS))
+// initialized returns ErrNotInitialized, wrapping the error of the last
+// attempt if any, until the cloud provider is ready.
+func (c *cloud) initialized() error {
+	if c.ready.Load() {
+		return nil
+	}
+	if err := c.startErr.Load(); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotInitialized, *err)
+	}
+	return ErrNotInitialized
+}
+
+// login checks the credentials of all accounts.
+func (c *cloud) login(ctx context.Context) error {
+	accounts := c.config().accounts
+	for i := range accounts {
+		err := c.loginAccount(ctx, &accounts[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loginAccount checks the credentials of an account by listing its
+// vServers, as the generated GetUserData response type cannot be decoded.
+// The cache is bypassed to actually reach SCP.
+func (c *cloud) loginAccount(ctx context.Context, account *AccountConfig) error {
+	req := &scp.GetVServers{
+		XMLNS:     xmlNS,
+		LoginName: account.Username,
+		Password:  account.Password,
+	}
+	_, err := c.uncached.GetVServersContext(ctx, req)
+	return err
+}
+
+// connect initializes the config and the client for the SCP endpoint.
+func (c *cloud) connect(ctx context.Context) error {
+	config := c.base.clone()
+	err := config.Initialize(ctx, c.client)
+	if err != nil {
+		return err
+	}
+	client, err := config.Endpoint.newSOAPClient()
+	if err != nil {
+		return err
+	}
+	c.uncached = newSCPClient(scp.NewWSEndUser(client), config.Endpoint.Retries)
+	c.server = newInventory(c.uncached, config.Cache.TTL)
+	c.current.Store(config)
+	for _, prefix := range config.prefixes {
+		if pool := config.poolOf(prefix); pool != "" {
+			klog.Infof("Taking control of failover IP: %s (pool '%s')", prefix.String(), pool)
+		} else {
+			klog.Infof("Taking control of failover IP: %s", prefix.String())
+		}
+	}
+	return nil
+}
+
+// config returns the current config, which is replaced as a whole once
+// the referenced ConfigMap or Secret changed.
+func (c *cloud) config() *Config {
+	return c.current.Load()
 }
 
 func (c *cloud) Instances() (cloudprovider.Instances, bool) {
@@ -93,49 +236,102 @@ func (c *cloud) HasClusterID() bool {
 }
 
 func (c *cloud) getServers(ctx context.Context) (*scp.GetVServersResponse, error) {
+	servers := &scp.GetVServersResponse{}
+	accounts := c.config().accounts
+	for i := range accounts {
+		resp, err := c.getAccountServers(ctx, &accounts[i])
+		if err != nil {
+			return nil, err
+		}
+		servers.Return_ = append(servers.Return_, resp.Return_...)
+	}
+	return servers, nil
+}
+
+func (c *cloud) getAccountServers(ctx context.Context, account *AccountConfig) (*scp.GetVServersResponse, error) {
 	req := &scp.GetVServers{
 		XMLNS:     xmlNS,
-		LoginName: c.config.Username,
-		Password:  c.config.Password,
+		LoginName: account.Username,
+		Password:  account.Password,
 	}
 	return c.server.GetVServersContext(ctx, req)
 }
 
+// accountOf returns the account owning a vServer, which is only looked up
+// if there are several accounts.
+func (c *cloud) accountOf(ctx context.Context, serverName string) (*AccountConfig, error) {
+	accounts := c.config().accounts
+	if len(accounts) == 1 {
+		return &accounts[0], nil
+	}
+	for i := range accounts {
+		resp, err := c.getAccountServers(ctx, &accounts[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range resp.Return_ {
+			if *name == serverName {
+				return &accounts[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: no account owns vServer '%s'", ErrUnknownServer, serverName)
+}
+
 func (c *cloud) getServerState(ctx context.Context, serverName string) (*scp.GetVServerStateResponse, error) {
+	account, err := c.accountOf(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
 	req := &scp.GetVServerState{
 		XMLNS:       xmlNS,
-		LoginName:   c.config.Username,
-		Password:    c.config.Password,
+		LoginName:   account.Username,
+		Password:    account.Password,
 		VserverName: serverName,
 	}
 	return c.server.GetVServerStateContext(ctx, req)
 }
 
 func (c *cloud) getServerInfo(ctx context.Context, serverName string) (*scp.GetVServerInformationResponse, error) {
+	account, err := c.accountOf(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
 	req := &scp.GetVServerInformation{
 		XMLNS:       xmlNS,
-		LoginName:   c.config.Username,
-		Password:    c.config.Password,
+		LoginName:   account.Username,
+		Password:    account.Password,
 		Vservername: serverName,
 	}
 	return c.server.GetVServerInformationContext(ctx, req)
 }
 
 func (c *cloud) getServerIPs(ctx context.Context, serverName string) (*scp.GetVServerIPsResponse, error) {
+	account, err := c.accountOf(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
 	req := &scp.GetVServerIPs{
 		XMLNS:       xmlNS,
-		LoginName:   c.config.Username,
-		Password:    c.config.Password,
+		LoginName:   account.Username,
+		Password:    account.Password,
 		VserverName: serverName,
 	}
 	return c.server.GetVServerIPsContext(ctx, req)
 }
 
 func (c *cloud) routeServerIP(ctx context.Context, routedIP, routedMask, serverName, interfaceMAC string) (*scp.ChangeIPRoutingResponse, error) {
+	if c.dryRun(nil, "would route failover IP '%s/%s' to interface '%s' of node '%s'", routedIP, routedMask, interfaceMAC, serverName) {
+		return &scp.ChangeIPRoutingResponse{Return_: true}, nil
+	}
+	account, err := c.accountOf(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
 	req := &scp.ChangeIPRouting{
 		XMLNS:                   xmlNS,
-		LoginName:               c.config.Username,
-		Password:                c.config.Password,
+		LoginName:               account.Username,
+		Password:                account.Password,
 		RoutedIP:                routedIP,
 		RoutedMask:              routedMask,
 		DestinationVserverName:  serverName,
@@ -144,15 +340,68 @@ func (c *cloud) routeServerIP(ctx context.Context, routedIP, routedMask, serverN
 	return c.server.ChangeIPRoutingContext(ctx, req)
 }
 
+// routeToServer routes a failover prefix to the public interface of a
+// vServer.
+func (c *cloud) routeToServer(ctx context.Context, prefix netip.Prefix, serverName string) error {
+	resp, err := c.getServerInfo(ctx, serverName)
+	if err != nil {
+		return err
+	}
+	iface := publicInterface(resp.Return_)
+	if iface == nil {
+		return fmt.Errorf("vServer '%s' has no public interface", serverName)
+	}
+	route, err := c.routeServerIP(ctx, prefix.Addr().String(), strconv.Itoa(prefix.Bits()), resp.Return_.VServerName, iface.Mac)
+	if err != nil {
+		return err
+	}
+	if !route.Return_ {
+		return ErrRouteRefused
+	}
+	return nil
+}
+
+// ipOwners returns the vServer each routed failover prefix is routed to,
+// as seen by SCP.
+func (c *cloud) ipOwners(ctx context.Context) (map[netip.Prefix]string, error) {
+	resp, err := c.getServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[netip.Prefix]string)
+	for _, name := range resp.Return_ {
+		ips, err := c.getServerIPs(ctx, *name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips.Return_ {
+			prefix, err := parseServerIP(*ip)
+			if err != nil {
+				return nil, err
+			}
+			owners[prefix.Masked()] = *name
+		}
+	}
+	return owners, nil
+}
+
 func newCloud(config io.Reader) (cloudprovider.Interface, error) {
 	if config == nil {
 		return nil, errors.New("missing cloud config file")
 	}
-	cfg := Config{}
-	dec := yaml.NewDecoder(config)
-	dec.KnownFields(true)
-	err := dec.Decode(&cfg)
-	return &cloud{config: &cfg}, err
+	cfg, err := loadConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	/* fail early, the referenced objects are only resolved on Initialize */
+	err = cfg.clone().complete(false).ToAggregate()
+	if err != nil {
+		return nil, err
+	}
+	c := &cloud{base: cfg, alloc: newAllocator()}
+	c.logins = newCredentialChecker(c)
+	c.current.Store(cfg.clone())
+	return c, nil
 }
 
 func init() {
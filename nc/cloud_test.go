@@ -0,0 +1,220 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mback2k/nc-failover-ccm/nc/scp/scptest"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	testUsername = "12345"
+	testPassword = "secret"
+)
+
+// newTestCloud returns a cloud backed by a fake SCP endpoint with the
+// vServers node-a and node-b and a fake clientset with the given objects.
+func newTestCloud(t *testing.T, config Config, objects ...runtime.Object) (*cloud, *scptest.Server) {
+	t.Helper()
+
+	server := scptest.NewServer(testUsername, testPassword)
+	t.Cleanup(server.Close)
+	server.AddVServer(scptest.VServer{
+		Name:  "node-a",
+		State: scptest.StateOnline,
+		Interfaces: []scptest.Interface{{
+			MAC:  "00:00:5e:00:53:0a",
+			IPv4: []string{"192.0.2.10"},
+			IPv6: []string{"2001:db8:a::1"},
+		}},
+	})
+	server.AddVServer(scptest.VServer{
+		Name:  "node-b",
+		State: scptest.StateOnline,
+		Interfaces: []scptest.Interface{{
+			MAC:  "00:00:5e:00:53:0b",
+			IPv4: []string{"192.0.2.11"},
+			IPv6: []string{"2001:db8:b::1"},
+		}},
+	})
+
+	config.Username = testUsername
+	config.Password = testPassword
+	config.Endpoint.URL = server.URL
+	client := fake.NewSimpleClientset(objects...)
+	cloud := &cloud{
+		base:   config,
+		client: client,
+		alloc:  newAllocator(),
+		events: record.NewFakeRecorder(100),
+	}
+	err := cloud.initialize(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cloud, server
+}
+
+func newTestNode(name string, ready bool) *v1.Node {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func newTestService(name string, annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Type:       v1.ServiceTypeLoadBalancer,
+			IPFamilies: []v1.IPFamily{v1.IPv4Protocol},
+		},
+	}
+}
+
+func TestNewCloud(t *testing.T) {
+	_, err := newCloud(nil)
+	if err == nil {
+		t.Error("expected error for missing config")
+	}
+}
+
+func TestCloudInitialize(t *testing.T) {
+	server := scptest.NewServer(testUsername, testPassword)
+	t.Cleanup(server.Close)
+	config := Config{
+		Username: testUsername,
+		Password: "wrong",
+		Failover: []string{"203.0.113.10/32"},
+		Endpoint: EndpointConfig{URL: server.URL},
+	}
+	cloud := &cloud{base: config, client: fake.NewSimpleClientset(), alloc: newAllocator()}
+	cloud.current.Store(config.clone())
+
+	_, err := newLoadBalancers(cloud).EnsureLoadBalancer(context.Background(), "", newTestService("web", nil), nil)
+	if !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("expected not initialized error, got: %v", err)
+	}
+	err = cloud.initialize(context.Background())
+	if !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("expected authentication error, got: %v", err)
+	}
+	cloud.startErr.Store(&err)
+	err = (&readinessController{cloud}).Check(nil)
+	if !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("expected not initialized error for failed login, got: %v", err)
+	}
+
+	cloud.base.Password = testPassword
+	err = cloud.initialize(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&readinessController{cloud}).Check(nil)
+	if err != nil {
+		t.Errorf("initialized cloud is not ready: %v", err)
+	}
+}
+
+func TestCloudAccounts(t *testing.T) {
+	cloud, server := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}})
+	server.AddAccount("67890", "other")
+	server.AddVServer(scptest.VServer{
+		Name:      "node-c",
+		State:     scptest.StateOnline,
+		LoginName: "67890",
+		Interfaces: []scptest.Interface{{
+			MAC:  "00:00:5e:00:53:0c",
+			IPv4: []string{"192.0.2.12"},
+			IPv6: []string{"2001:db8:c::1"},
+		}},
+	})
+
+	cloud.base.Accounts = []AccountConfig{{Name: "second", Username: "67890", Password: "other"}}
+	err := cloud.initialize(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := cloud.getServers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers.Return_) != 3 {
+		t.Errorf("found %d vServers across accounts, want 3", len(servers.Return_))
+	}
+	resp, err := cloud.routeServerIP(context.Background(), "203.0.113.10", "32", "node-c", "00:00:5e:00:53:0c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Return_ {
+		t.Error("failover IP not routed to vServer of second account")
+	}
+	_, err = cloud.getServerInfo(context.Background(), "node-x")
+	if !errors.Is(err, ErrUnknownServer) {
+		t.Errorf("expected unknown server error, got: %v", err)
+	}
+}
+
+func TestCredentialChecker(t *testing.T) {
+	cloud, _ := newTestCloud(t, Config{
+		Secret:   ObjectReference{Name: "ccm", Namespace: "kube-system"},
+		Failover: []string{"203.0.113.10/32"},
+	}, &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "ccm", Namespace: "kube-system"}})
+	logins := newCredentialChecker(cloud)
+	events := cloud.events.(*record.FakeRecorder).Events
+
+	cloud.config().accounts[0].Password = "wrong"
+	logins.check(context.Background())
+	err := logins.Check(nil)
+	if !errors.Is(err, ErrAuthentication) {
+		t.Errorf("expected authentication error, got: %v", err)
+	}
+	if event := <-events; !strings.HasPrefix(event, "Warning AuthenticationFailed") {
+		t.Errorf("unexpected event: %s", event)
+	}
+
+	cloud.config().accounts[0].Password = testPassword
+	logins.check(context.Background())
+	err = logins.Check(nil)
+	if err != nil {
+		t.Errorf("accepted credentials are reported as failed: %v", err)
+	}
+	if event := <-events; !strings.HasPrefix(event, "Normal Authenticated") {
+		t.Errorf("unexpected event: %s", event)
+	}
+}
@@ -18,41 +18,177 @@ package nc
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"io"
+	"maps"
 	"net/netip"
+	"os"
+	"slices"
 	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/klog/v2"
 )
 
+const (
+	configAPIVersion = "nc-failover.k8s.mback2k.net/v1"
+	configKind       = "CloudConfig"
+
+	configFailover     = "failover"
+	configFailoverPool = "failover."
+	configUsername     = "username."
+	configPassword     = "password."
+
+	envUsername = "NC_USERNAME"
+	envPassword = "NC_PASSWORD"
+
+	defaultNamespace = "kube-system"
+)
+
+// ObjectReference refers to the ConfigMap or Secret with additional config.
+// It may also be given as a string in the form name@namespace.
+type ObjectReference struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+func (r *ObjectReference) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var ref string
+		if err := node.Decode(&ref); err != nil {
+			return err
+		}
+		r.Name, r.Namespace, _ = strings.Cut(ref, "@")
+		return nil
+	}
+	type plain ObjectReference
+	return node.Decode((*plain)(r))
+}
+
+func (r ObjectReference) IsZero() bool {
+	return r.Name == "" && r.Namespace == ""
+}
+
+func (r ObjectReference) String() string {
+	return r.Namespace + "/" + r.Name
+}
+
+func (r *ObjectReference) Initialize(path *field.Path) field.ErrorList {
+	if r.IsZero() {
+		return nil
+	}
+	if r.Namespace == "" {
+		r.Namespace = defaultNamespace
+	}
+	errs := field.ErrorList{}
+	if r.Name == "" {
+		errs = append(errs, field.Required(path.Child("name"), ""))
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(r.Name) {
+		errs = append(errs, field.Invalid(path.Child("name"), r.Name, msg))
+	}
+	for _, msg := range validation.IsDNS1123Label(r.Namespace) {
+		errs = append(errs, field.Invalid(path.Child("namespace"), r.Namespace, msg))
+	}
+	return errs
+}
+
+type AccountConfig struct {
+	Name         string `yaml:"name"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	UsernameFile string `yaml:"usernameFile"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
 type Config struct {
-	Config   string
-	Secret   string
-	Username string
-	Password string
-	Failover []string
-	prefixes []netip.Prefix
+	APIVersion   string              `yaml:"apiVersion"`
+	Kind         string              `yaml:"kind"`
+	Config       ObjectReference     `yaml:"config"`
+	Secret       ObjectReference     `yaml:"secret"`
+	Username     string              `yaml:"username"`
+	Password     string              `yaml:"password"`
+	UsernameFile string              `yaml:"usernameFile"`
+	PasswordFile string              `yaml:"passwordFile"`
+	Accounts     []AccountConfig     `yaml:"accounts"`
+	Endpoint     EndpointConfig      `yaml:"endpoint"`
+	Cache        CacheConfig         `yaml:"cache"`
+	Failover     []string            `yaml:"failover"`
+	Pools        map[string][]string `yaml:"pools"`
+	Health       HealthConfig        `yaml:"health"`
+	Nodes        NodeSelectionConfig `yaml:"nodes"`
+	Drift        DriftConfig         `yaml:"drift"`
+	DryRun       bool                `yaml:"dryRun"`
+	prefixes     []netip.Prefix
+	pools        map[string][]netip.Prefix
+	accounts     []AccountConfig
+}
+
+// loadConfig decodes a cloud config file, rejecting unknown fields.
+func loadConfig(reader io.Reader) (Config, error) {
+	config := Config{}
+	dec := yaml.NewDecoder(reader)
+	dec.KnownFields(true)
+	err := dec.Decode(&config)
+	return config, err
 }
 
+// ValidateConfigFile checks a cloud config file without resolving the
+// referenced ConfigMap and Secret, environment variables and files.
+func ValidateConfigFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	config, err := loadConfig(file)
+	if err != nil {
+		return err
+	}
+	return config.complete(false).ToAggregate()
+}
+
+// Initialize resolves the referenced ConfigMap and Secret as well as the
+// credentials and then defaults and validates the config.
 func (c *Config) Initialize(ctx context.Context, client kubernetes.Interface) error {
-	if c.Config != "" {
-		name, namespace, _ := strings.Cut(c.Config, "@")
-		config, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	/* validate the references before they are resolved */
+	errs := c.Config.Initialize(field.NewPath("config"))
+	errs = append(errs, c.Secret.Initialize(field.NewPath("secret"))...)
+	if len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	if !c.Config.IsZero() {
+		config, err := client.CoreV1().ConfigMaps(c.Config.Namespace).Get(ctx, c.Config.Name, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
 		if username, ok := config.Data["username"]; ok {
 			c.Username = username
 		}
-		if failover, ok := config.Data["failover"]; ok {
-			c.Failover = strings.Split(failover, ",")
+		for key, username := range config.Data {
+			if account, ok := strings.CutPrefix(key, configUsername); ok {
+				c.account(account).Username = username
+			}
+		}
+		if failover, ok := config.Data[configFailover]; ok {
+			c.Failover = splitList(failover)
+		}
+		for key, failover := range config.Data {
+			if pool, ok := strings.CutPrefix(key, configFailoverPool); ok {
+				if c.Pools == nil {
+					c.Pools = make(map[string][]string)
+				}
+				c.Pools[pool] = splitList(failover)
+			}
 		}
 	}
-	if c.Secret != "" {
-		name, namespace, _ := strings.Cut(c.Secret, "@")
-		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if !c.Secret.IsZero() {
+		secret, err := client.CoreV1().Secrets(c.Secret.Namespace).Get(ctx, c.Secret.Name, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
@@ -62,27 +198,232 @@ func (c *Config) Initialize(ctx context.Context, client kubernetes.Interface) er
 		if password, ok := secret.Data["password"]; ok {
 			c.Password = string(password)
 		}
+		for key, value := range secret.Data {
+			if account, ok := strings.CutPrefix(key, configUsername); ok {
+				c.account(account).Username = string(value)
+			} else if account, ok := strings.CutPrefix(key, configPassword); ok {
+				c.account(account).Password = string(value)
+			}
+		}
+	}
+	err := c.loadCredentials()
+	if err != nil {
+		return err
 	}
-	if c.Username == "" {
-		return errors.New("missing cloud username")
+	return c.complete(true).ToAggregate()
+}
+
+// complete defaults and validates the config, collecting all errors. Until
+// the config is resolved, credentials and failover IPs are only required if
+// they cannot come from the referenced objects, environment or files.
+func (c *Config) complete(resolved bool) field.ErrorList {
+	if c.APIVersion == "" && c.Kind == "" {
+		/* unversioned configs predate the schema */
+		c.APIVersion = configAPIVersion
+		c.Kind = configKind
 	}
-	if c.Password == "" {
-		return errors.New("missing cloud password")
+	errs := field.ErrorList{}
+	if c.APIVersion != configAPIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{configAPIVersion}))
 	}
-	if len(c.Failover) == 0 {
-		return errors.New("missing cloud failover")
+	if c.Kind != configKind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{configKind}))
 	}
-	for _, failover := range c.Failover {
-		prefix, err := netip.ParsePrefix(failover)
+	errs = append(errs, c.Config.Initialize(field.NewPath("config"))...)
+	errs = append(errs, c.Secret.Initialize(field.NewPath("secret"))...)
+
+	c.accounts = nil
+	/* the default account is optional if there are named accounts */
+	if c.Username != "" || c.Password != "" || len(c.Accounts) == 0 {
+		if resolved && c.Username == "" {
+			errs = append(errs, field.Required(field.NewPath("username"), "missing cloud username"))
+		}
+		if resolved && c.Password == "" {
+			errs = append(errs, field.Required(field.NewPath("password"), "missing cloud password"))
+		}
+		c.accounts = append(c.accounts, AccountConfig{Username: c.Username, Password: c.Password, UsernameFile: c.UsernameFile, PasswordFile: c.PasswordFile})
+	}
+	names := make(map[string]bool)
+	for i, account := range c.Accounts {
+		path := field.NewPath("accounts").Index(i)
+		if account.Name == "" {
+			errs = append(errs, field.Required(path.Child("name"), "missing cloud account name"))
+		} else if names[account.Name] {
+			errs = append(errs, field.Duplicate(path.Child("name"), account.Name))
+		}
+		names[account.Name] = true
+		if resolved && account.Username == "" {
+			errs = append(errs, field.Required(path.Child("username"), fmt.Sprintf("missing cloud username for account '%s'", account.Name)))
+		}
+		if resolved && account.Password == "" {
+			errs = append(errs, field.Required(path.Child("password"), fmt.Sprintf("missing cloud password for account '%s'", account.Name)))
+		}
+		c.accounts = append(c.accounts, account)
+	}
+	errs = append(errs, c.Endpoint.Initialize(field.NewPath("endpoint"))...)
+	errs = append(errs, c.Cache.Initialize(field.NewPath("cache"))...)
+	errs = append(errs, c.Nodes.Initialize(field.NewPath("nodes"))...)
+	errs = append(errs, c.Health.Initialize(field.NewPath("health"))...)
+	errs = append(errs, c.Drift.Initialize(field.NewPath("drift"))...)
+
+	if len(c.Failover) == 0 && len(c.Pools) == 0 && (resolved || c.Config.IsZero()) {
+		errs = append(errs, field.Required(field.NewPath("failover"), "missing cloud failover"))
+	}
+	c.prefixes = nil
+	c.pools = make(map[string][]netip.Prefix)
+	for _, pool := range slices.Sorted(maps.Keys(c.Pools)) {
+		path := field.NewPath("pools").Key(pool)
+		if pool == "" {
+			errs = append(errs, field.Required(path, "missing cloud failover pool name"))
+			continue
+		}
+		errs = append(errs, c.addPrefixes(path, pool, c.Pools[pool])...)
+	}
+	errs = append(errs, c.addPrefixes(field.NewPath("failover"), "", c.Failover)...)
+	return errs
+}
+
+// clone returns a copy of the config which can be initialized without
+// modifying the original.
+func (c *Config) clone() *Config {
+	config := *c
+	config.Failover = slices.Clone(c.Failover)
+	config.Pools = maps.Clone(c.Pools)
+	config.Accounts = slices.Clone(c.Accounts)
+	return &config
+}
+
+// loadCredentials overrides the credentials with environment variables and
+// then with files. Credentials are therefore taken from, in order of
+// increasing precedence: the cloud config file, the ConfigMap (usernames
+// only), the Secret, the environment and files like projected Secret
+// volumes, which are re-read on change by the reload controller.
+// Environment variables of named accounts carry the upper-cased account
+// name as suffix, e.g. NC_PASSWORD_SECOND for the account "second".
+func (c *Config) loadCredentials() error {
+	if username, ok := os.LookupEnv(envUsername); ok {
+		c.Username = username
+	}
+	if password, ok := os.LookupEnv(envPassword); ok {
+		c.Password = password
+	}
+	for i := range c.Accounts {
+		account := &c.Accounts[i]
+		if username, ok := os.LookupEnv(envUsername + "_" + envSuffix(account.Name)); ok {
+			account.Username = username
+		}
+		if password, ok := os.LookupEnv(envPassword + "_" + envSuffix(account.Name)); ok {
+			account.Password = password
+		}
+	}
+	err := readCredential(c.UsernameFile, &c.Username)
+	if err != nil {
+		return err
+	}
+	err = readCredential(c.PasswordFile, &c.Password)
+	if err != nil {
+		return err
+	}
+	for i := range c.Accounts {
+		account := &c.Accounts[i]
+		err := readCredential(account.UsernameFile, &account.Username)
+		if err != nil {
+			return err
+		}
+		err = readCredential(account.PasswordFile, &account.Password)
 		if err != nil {
 			return err
 		}
-		c.prefixes = append(c.prefixes, prefix)
-		klog.Infof("Taking control of failover IP: %s", prefix.String())
 	}
 	return nil
 }
 
+// credentialFiles returns the files credentials are read from.
+func (c *Config) credentialFiles() []string {
+	files := []string{}
+	for _, account := range c.accounts {
+		for _, file := range []string{account.UsernameFile, account.PasswordFile} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+func readCredential(file string, value *string) error {
+	if file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	*value = strings.TrimSpace(string(data))
+	return nil
+}
+
+func envSuffix(name string) string {
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, name)
+}
+
+// sameState reports whether both configs manage the same failover IPs and
+// accounts, which are the parts taken from the ConfigMap and Secret.
+func (c *Config) sameState(other *Config) bool {
+	return slices.Equal(c.prefixes, other.prefixes) &&
+		slices.Equal(c.accounts, other.accounts) &&
+		maps.EqualFunc(c.pools, other.pools, slices.Equal)
+}
+
+// account returns the named account, which is added if it is missing.
+func (c *Config) account(name string) *AccountConfig {
+	index := slices.IndexFunc(c.Accounts, func(account AccountConfig) bool {
+		return account.Name == name
+	})
+	if index < 0 {
+		c.Accounts = append(c.Accounts, AccountConfig{Name: name})
+		index = len(c.Accounts) - 1
+	}
+	return &c.Accounts[index]
+}
+
+func (c *Config) addPrefixes(path *field.Path, pool string, failovers []string) field.ErrorList {
+	errs := field.ErrorList{}
+	for i, failover := range failovers {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(failover))
+		if err != nil {
+			errs = append(errs, field.Invalid(path.Index(i), failover, err.Error()))
+			continue
+		}
+		/* the whole subnet is routed, so refer to it by its network address */
+		prefix = prefix.Masked()
+		index := slices.IndexFunc(c.prefixes, prefix.Overlaps)
+		if index >= 0 && c.prefixes[index] == prefix {
+			errs = append(errs, field.Duplicate(path.Index(i), prefix.String()))
+			continue
+		} else if index >= 0 {
+			errs = append(errs, field.Invalid(path.Index(i), failover, fmt.Sprintf("overlaps failover subnet %s", c.prefixes[index])))
+			continue
+		}
+		c.prefixes = append(c.prefixes, prefix)
+		c.pools[pool] = append(c.pools[pool], prefix)
+	}
+	return errs
+}
+
+// splitList splits a list of failover IPs from the ConfigMap, which may be
+// separated by commas or whitespace.
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
 func (c *Config) IsFailoverIP(addr netip.Addr) bool {
 	for _, prefix := range c.prefixes {
 		if prefix.Contains(addr) {
@@ -91,3 +432,44 @@ func (c *Config) IsFailoverIP(addr netip.Addr) bool {
 	}
 	return false
 }
+
+// prefixOf returns the configured prefix containing the address.
+func (c *Config) prefixOf(addr netip.Addr) (netip.Prefix, bool) {
+	index := slices.IndexFunc(c.prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+	if index < 0 {
+		return netip.Prefix{}, false
+	}
+	return c.prefixes[index], true
+}
+
+// PoolPrefixes returns the failover prefixes a service of the given pool
+// may claim. The empty pool name refers to the unnamed failover list.
+func (c *Config) PoolPrefixes(pool string) ([]netip.Prefix, error) {
+	prefixes, ok := c.pools[pool]
+	if !ok && pool != "" {
+		return nil, fmt.Errorf("unknown cloud failover pool: %s", pool)
+	}
+	return prefixes, nil
+}
+
+// poolOf returns the name of the pool a configured prefix belongs to.
+func (c *Config) poolOf(prefix netip.Prefix) string {
+	for pool, prefixes := range c.pools {
+		if slices.Contains(prefixes, prefix) {
+			return pool
+		}
+	}
+	return ""
+}
+
+// IsPoolIP reports whether the address belongs to the given pool.
+func (c *Config) IsPoolIP(pool string, addr netip.Addr) bool {
+	for _, prefix := range c.pools[pool] {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigCredentials(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ccm", Namespace: "kube-system"},
+		Data: map[string][]byte{
+			"username":                []byte("secret-user"),
+			"password":                []byte("secret-pass"),
+			"password.second-account": []byte("secret-second"),
+		},
+	}
+	file := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(file, []byte("file-pass\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envUsername, "env-user")
+	t.Setenv(envPassword, "env-pass")
+	t.Setenv(envUsername+"_SECOND_ACCOUNT", "env-second")
+
+	config := Config{
+		Username:     "config-user",
+		Secret:       ObjectReference{Name: "ccm", Namespace: "kube-system"},
+		PasswordFile: file,
+		Failover:     []string{"203.0.113.10/32"},
+		Accounts:     []AccountConfig{{Name: "second-account", Password: "config-second"}},
+	}
+	err = config.Initialize(context.Background(), fake.NewSimpleClientset(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.accounts) != 2 {
+		t.Fatalf("found %d accounts, want 2", len(config.accounts))
+	}
+	if account := config.accounts[0]; account.Username != "env-user" || account.Password != "file-pass" {
+		t.Errorf("default account has credentials %s:%s, want env-user:file-pass", account.Username, account.Password)
+	}
+	if account := config.accounts[1]; account.Username != "env-second" || account.Password != "secret-second" {
+		t.Errorf("named account has credentials %s:%s, want env-second:secret-second", account.Username, account.Password)
+	}
+	if files := config.credentialFiles(); len(files) != 1 || files[0] != file {
+		t.Errorf("found credential files %v, want [%s]", files, file)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	config, err := loadConfig(strings.NewReader(`
+config: ccm
+secret:
+  name: ccm-credentials
+failover: [203.0.113.10/32]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := config.complete(false)
+	if len(errs) > 0 {
+		t.Fatal(errs.ToAggregate())
+	}
+	if config.Config != (ObjectReference{Name: "ccm", Namespace: defaultNamespace}) {
+		t.Errorf("config map reference is %s, want kube-system/ccm", config.Config)
+	}
+	if config.Secret != (ObjectReference{Name: "ccm-credentials", Namespace: defaultNamespace}) {
+		t.Errorf("secret reference is %s, want kube-system/ccm-credentials", config.Secret)
+	}
+	if config.APIVersion != configAPIVersion || config.Kind != configKind {
+		t.Errorf("unversioned config defaulted to %s %s", config.APIVersion, config.Kind)
+	}
+
+	config = Config{
+		APIVersion: "v2",
+		Kind:       configKind,
+		Failover:   []string{"203.0.113.10/32", "bogus", "203.0.113.10/32"},
+		Health:     HealthConfig{Probe: "ping"},
+	}
+	errs = config.complete(true)
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	want := []string{"apiVersion", "username", "password", "health.probe", "failover[1]", "failover[2]"}
+	if !slices.Equal(fields, want) {
+		t.Errorf("found errors for %v, want %v", fields, want)
+	}
+}
+
+func TestConfigFailoverOverlaps(t *testing.T) {
+	for _, failover := range [][]string{
+		{"203.0.113.8/29", "203.0.113.10/32"},
+		{"203.0.113.10/32", "203.0.113.8/29"},
+	} {
+		config := Config{Username: testUsername, Password: testPassword, Failover: failover}
+		errs := config.complete(true)
+		if len(errs) != 1 || errs[0].Field != "failover[1]" {
+			t.Errorf("found errors %v for overlapping failover subnets %v", errs, failover)
+		}
+	}
+}
+
+func TestConfigFailoverList(t *testing.T) {
+	got := splitList("203.0.113.10/32, 203.0.113.11/32\n203.0.113.12/32,")
+	want := []string{"203.0.113.10/32", "203.0.113.11/32", "203.0.113.12/32"}
+	if !slices.Equal(got, want) {
+		t.Errorf("split failover list into %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/controller-manager/pkg/healthz"
+	"k8s.io/klog/v2"
+)
+
+const (
+	credentialsControllerName = "nc-failover-credentials"
+
+	defaultAccountName = "default"
+)
+
+// credentialChecker periodically checks whether SCP still accepts the
+// credentials of all accounts, so that broken credentials are noticed
+// before a failover is attempted. It reports through /healthz, a metric
+// and Events on the referenced Secret or ConfigMap.
+type credentialChecker struct {
+	cloud  *cloud
+	mutex  sync.Mutex
+	failed map[string]error
+}
+
+func newCredentialChecker(cloud *cloud) *credentialChecker {
+	return &credentialChecker{
+		cloud:  cloud,
+		failed: make(map[string]error),
+	}
+}
+
+func (k *credentialChecker) Name() string {
+	return credentialsControllerName
+}
+
+func (k *credentialChecker) HealthChecker() healthz.UnnamedHealthChecker {
+	return k
+}
+
+// Check fails if SCP rejected the credentials of an account on the last
+// check, but not on other errors like timeouts.
+func (k *credentialChecker) Check(req *http.Request) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if len(k.failed) == 0 {
+		return nil
+	}
+	names := slices.Sorted(maps.Keys(k.failed))
+	return fmt.Errorf("%w for accounts: %s", ErrAuthentication, strings.Join(names, ", "))
+}
+
+func (k *credentialChecker) Run(ctx context.Context) {
+	interval := k.cloud.config().Endpoint.CheckInterval
+	if interval <= 0 {
+		return
+	}
+	klog.Infof("Starting credential check every %s", interval)
+	wait.UntilWithContext(ctx, k.check, interval)
+}
+
+func (k *credentialChecker) check(ctx context.Context) {
+	config := k.cloud.config()
+	names := make(map[string]bool)
+	for i := range config.accounts {
+		account := &config.accounts[i]
+		name := account.Name
+		if name == "" {
+			name = defaultAccountName
+		}
+		names[name] = true
+		err := k.cloud.loginAccount(ctx, account)
+		if err != nil && !errors.Is(err, ErrAuthentication) {
+			klog.Warningf("Failed to check credentials of account '%s': %v", name, err)
+			continue
+		}
+		k.record(config, name, err)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	/* forget accounts removed on reload */
+	for name := range k.failed {
+		if !names[name] {
+			delete(k.failed, name)
+			scpCredentialsValid.DeleteLabelValues(name)
+		}
+	}
+}
+
+func (k *credentialChecker) record(config *Config, name string, err error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	_, failed := k.failed[name]
+	object := credentialsObject(config)
+	if err == nil {
+		scpCredentialsValid.WithLabelValues(name).Set(1)
+		if failed {
+			delete(k.failed, name)
+			klog.Infof("SCP accepts the credentials of account '%s' again", name)
+			if object != nil {
+				k.cloud.events.Eventf(object, v1.EventTypeNormal, eventReasonAuthenticated,
+					"SCP accepts the credentials of account '%s' again", name)
+			}
+		}
+		return
+	}
+	scpCredentialsValid.WithLabelValues(name).Set(0)
+	k.failed[name] = err
+	if !failed {
+		klog.Errorf("SCP rejected the credentials of account '%s': %v", name, err)
+		if object != nil {
+			k.cloud.events.Eventf(object, v1.EventTypeWarning, eventReasonAuthenticationFailed,
+				"SCP rejected the credentials of account '%s': %v", name, err)
+		}
+	}
+}
+
+// credentialsObject returns the object to record credential Events on,
+// which is the referenced Secret or otherwise the ConfigMap.
+func credentialsObject(config *Config) runtime.Object {
+	switch {
+	case !config.Secret.IsZero():
+		return &v1.ObjectReference{Kind: "Secret", APIVersion: "v1", Namespace: config.Secret.Namespace, Name: config.Secret.Name}
+	case !config.Config.IsZero():
+		return &v1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1", Namespace: config.Config.Namespace, Name: config.Config.Name}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+var controlPlaneLabels = []string{
+	"node-role.kubernetes.io/control-plane",
+	"node-role.kubernetes.io/master",
+}
+
+func isNodeReady(node *v1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady && cond.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// isEligible reports whether failover IPs may be routed to a node, which
+// must be ready, not cordoned, free of excluded taints, not excluded from
+// external loadbalancers, not part of the control-plane unless allowed and
+// match the configured node selector.
+func (n *NodeSelectionConfig) isEligible(node *v1.Node) bool {
+	if !isNodeReady(node) || node.Spec.Unschedulable {
+		return false
+	}
+	if slices.ContainsFunc(node.Spec.Taints, func(taint v1.Taint) bool {
+		return slices.Contains(n.ExcludeTaints, taint.Key)
+	}) {
+		return false
+	}
+	if _, ok := node.Labels[v1.LabelNodeExcludeBalancers]; ok {
+		return false
+	}
+	if !n.AllowControlPlane {
+		for _, label := range controlPlaneLabels {
+			if _, ok := node.Labels[label]; ok {
+				return false
+			}
+		}
+	}
+	return n.selector == nil || n.selector.Matches(labels.Set(node.Labels))
+}
+
+// drainController watches the nodes and moves the failover IPs away from
+// nodes that are still ready, but became ineligible by being cordoned or
+// tainted, before they are actually shut down.
+type drainController struct {
+	cloud *cloud
+	queue workqueue.TypedRateLimitingInterface[string]
+}
+
+func newDrainController(cloud *cloud) *drainController {
+	return &drainController{
+		cloud: cloud,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "nc-failover-drain"},
+		),
+	}
+}
+
+func (d *drainController) Run(ctx context.Context) {
+	defer d.queue.ShutDown()
+
+	factory := informers.NewSharedInformerFactory(d.cloud.client, 10*time.Minute)
+	informer := factory.Core().V1().Nodes().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { d.enqueue(nil, obj) },
+		UpdateFunc: d.enqueue,
+	})
+	if err != nil {
+		klog.Errorf("Failed to watch nodes: %v", err)
+		return
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+
+	klog.Infof("Starting drain controller")
+	go wait.UntilWithContext(ctx, d.worker, time.Second)
+	<-ctx.Done()
+}
+
+// enqueue queues ready nodes that became ineligible, or that are
+// ineligible and still carry failover services, so resyncs retry them.
+func (d *drainController) enqueue(old, obj interface{}) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return
+	}
+	config := d.cloud.config()
+	/* not ready nodes are handled by the service controller */
+	if !isNodeReady(node) || config.Nodes.isEligible(node) {
+		return
+	}
+	if prev, ok := old.(*v1.Node); ok && config.Nodes.isEligible(prev) || hasServices(node) {
+		d.queue.Add(node.Name)
+	}
+}
+
+// hasServices reports whether failover services are labelled on the node.
+func hasServices(node *v1.Node) bool {
+	for label, value := range node.Labels {
+		/* removed services keep an empty label */
+		if strings.HasPrefix(label, nodeService) && value == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *drainController) worker(ctx context.Context) {
+	for d.processNext(ctx) {
+	}
+}
+
+func (d *drainController) processNext(ctx context.Context) bool {
+	key, quit := d.queue.Get()
+	if quit {
+		return false
+	}
+	defer d.queue.Done(key)
+
+	err := d.sync(ctx, key)
+	if err != nil {
+		klog.Errorf("Failed to drain failover IPs from node '%s': %v", key, err)
+		d.queue.AddRateLimited(key)
+		return true
+	}
+	d.queue.Forget(key)
+	return true
+}
+
+func (d *drainController) sync(ctx context.Context, nodeName string) error {
+	core := d.cloud.client.CoreV1()
+	node, err := core.Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if d.cloud.config().Nodes.isEligible(node) {
+		return nil
+	}
+	selector, err := labels.ValidatedSelectorFromSet(
+		map[string]string{serviceNode: nodeName},
+	)
+	if err != nil {
+		return err
+	}
+	services, err := core.Services("").List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return err
+	}
+	if len(services.Items) == 0 {
+		return nil
+	}
+
+	nodes, err := core.Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	candidates := make([]*v1.Node, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		candidates = append(candidates, &nodes.Items[i])
+	}
+	ctx = withFailover(ctx, rerouteReasonIneligible, time.Now())
+	lb := newLoadBalancers(d.cloud)
+	for _, service := range services.Items {
+		klog.Warningf("Moving service '%s' away from ineligible node '%s'", serviceKey(&service), nodeName)
+		_, err := lb.EnsureLoadBalancer(ctx, "", &service, candidates)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestNodeEligibility(t *testing.T) {
+	config := NodeSelectionConfig{}
+	config.Initialize(field.NewPath("nodes"))
+
+	node := newTestNode("node-a", true)
+	if !config.isEligible(node) {
+		t.Error("ready node is not eligible")
+	}
+	node.Spec.Unschedulable = true
+	if config.isEligible(node) {
+		t.Error("cordoned node is eligible")
+	}
+	node.Spec.Unschedulable = false
+	node.Spec.Taints = []v1.Taint{{Key: v1.LabelNodeExcludeBalancers, Effect: v1.TaintEffectNoSchedule}}
+	if config.isEligible(node) {
+		t.Error("tainted node is eligible")
+	}
+	if !(&NodeSelectionConfig{ExcludeTaints: []string{}}).isEligible(node) {
+		t.Error("tainted node is not eligible without excluded taints")
+	}
+}
+
+func TestNodeEligibilityLabels(t *testing.T) {
+	config := NodeSelectionConfig{Selector: "pool=edge"}
+	errs := config.Initialize(field.NewPath("nodes"))
+	if len(errs) > 0 {
+		t.Fatal(errs.ToAggregate())
+	}
+
+	node := newTestNode("node-a", true)
+	node.Labels = map[string]string{"pool": "edge"}
+	if !config.isEligible(node) {
+		t.Error("selected node is not eligible")
+	}
+	node.Labels["node-role.kubernetes.io/control-plane"] = ""
+	if config.isEligible(node) {
+		t.Error("control-plane node is eligible")
+	}
+	config.AllowControlPlane = true
+	if !config.isEligible(node) {
+		t.Error("allowed control-plane node is not eligible")
+	}
+	node.Labels[v1.LabelNodeExcludeBalancers] = "true"
+	if config.isEligible(node) {
+		t.Error("excluded node is eligible")
+	}
+	node.Labels = map[string]string{"pool": "core"}
+	if config.isEligible(node) {
+		t.Error("unselected node is eligible")
+	}
+}
+
+func TestDrainControllerMovesCordonedNode(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, server := newTestCloud(t, Config{Failover: []string{prefix.String()}},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+
+	_, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := server.Owner(prefix); owner != "node-a" {
+		t.Fatalf("failover IP routed to '%s', want 'node-a'", owner)
+	}
+
+	node, err := cloud.client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Spec.Unschedulable = true
+	_, err = cloud.client.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newDrainController(cloud).sync(context.Background(), "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := server.Owner(prefix); owner != "node-b" {
+		t.Errorf("failover IP routed to '%s', want 'node-b'", owner)
+	}
+}
+
+func TestDrainControllerEnqueue(t *testing.T) {
+	cloud, _ := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}})
+	cordoned := newTestNode("node-a", true)
+	cordoned.Spec.Unschedulable = true
+	labelled := cordoned.DeepCopy()
+	labelled.Labels = map[string]string{nodeService + "web": "true"}
+	removed := cordoned.DeepCopy()
+	removed.Labels = map[string]string{nodeService + "web": ""}
+
+	for _, tc := range []struct {
+		name   string
+		old    interface{}
+		obj    *v1.Node
+		queued bool
+	}{
+		{"added eligible", nil, newTestNode("node-a", true), false},
+		{"added ineligible", nil, cordoned, false},
+		{"added ineligible with services", nil, labelled, true},
+		{"became ineligible", newTestNode("node-a", true), cordoned, true},
+		{"stayed ineligible", cordoned, cordoned, false},
+		{"stayed ineligible with services", labelled, labelled, true},
+		{"stayed ineligible with removed services", removed, removed, false},
+		{"became not ready", newTestNode("node-a", true), newTestNode("node-a", false), false},
+	} {
+		drain := newDrainController(cloud)
+		drain.enqueue(tc.old, tc.obj)
+		if queued := drain.queue.Len() > 0; queued != tc.queued {
+			t.Errorf("%s: node queued is %t, want %t", tc.name, queued, tc.queued)
+		}
+		drain.queue.ShutDown()
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	driftAuthoritativeKubernetes = "kubernetes"
+	driftAuthoritativeSCP        = "scp"
+)
+
+type DriftConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Interval      time.Duration `yaml:"interval"`
+	Authoritative string        `yaml:"authoritative"`
+}
+
+func (d *DriftConfig) Initialize(path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if d.Interval <= 0 {
+		d.Interval = time.Minute
+	}
+	if d.Authoritative == "" {
+		d.Authoritative = driftAuthoritativeKubernetes
+	}
+	if d.Authoritative != driftAuthoritativeKubernetes && d.Authoritative != driftAuthoritativeSCP {
+		errs = append(errs, field.NotSupported(path.Child("authoritative"), d.Authoritative, []string{driftAuthoritativeKubernetes, driftAuthoritativeSCP}))
+	}
+	return errs
+}
+
+// driftController periodically compares the vServers SCP routes the
+// failover IPs to with the nodes recorded on the services, which drift
+// apart if an IP is moved in the SCP web UI. If Kubernetes is
+// authoritative, the IPs are routed back to the recorded node. If SCP is
+// authoritative, the node SCP routes all IPs of a service to is recorded
+// instead, as long as it is an eligible node. Subnets shared by services
+// recorded on different nodes are left alone, as they cannot be routed to
+// all of them.
+type driftController struct {
+	cloud  *cloud
+	config *DriftConfig
+}
+
+func newDriftController(cloud *cloud) *driftController {
+	return &driftController{
+		cloud:  cloud,
+		config: &cloud.config().Drift,
+	}
+}
+
+func (d *driftController) Run(ctx context.Context) {
+	klog.Infof("Starting drift controller every %s with %s being authoritative", d.config.Interval, d.config.Authoritative)
+	wait.UntilWithContext(ctx, d.reconcile, d.config.Interval)
+}
+
+// drift is a failover IP of a service routed to another vServer.
+type drift struct {
+	ip     string
+	prefix netip.Prefix
+	owner  string
+}
+
+func (d *driftController) reconcile(ctx context.Context) {
+	core := d.cloud.client.CoreV1()
+	services, err := core.Services("").List(ctx, metav1.ListOptions{LabelSelector: serviceNode})
+	if err != nil {
+		klog.Errorf("Failed to list services for drift detection: %v", err)
+		return
+	}
+	if len(services.Items) == 0 {
+		return
+	}
+	nodes, err := core.Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Failed to list nodes for drift detection: %v", err)
+		return
+	}
+	owners, err := d.cloud.ipOwners(ctx)
+	if err != nil {
+		klog.Errorf("Failed to query failover IP routing for drift detection: %v", err)
+		return
+	}
+
+	candidates := make([]*v1.Node, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		candidates = append(candidates, &nodes.Items[i])
+	}
+	subnets := d.subnets(services.Items)
+	for i := range services.Items {
+		err := d.sync(ctx, &services.Items[i], candidates, owners, subnets)
+		if err != nil {
+			klog.Errorf("Failed to repair drift of service '%s': %v", serviceKey(&services.Items[i]), err)
+		}
+	}
+}
+
+// subnets returns the nodes the services sharing each failover subnet are
+// recorded on.
+func (d *driftController) subnets(services []v1.Service) map[netip.Prefix][]string {
+	config := d.cloud.config()
+	subnets := make(map[netip.Prefix][]string)
+	for i := range services {
+		recorded := services[i].Labels[serviceNode]
+		for _, ingress := range services[i].Status.LoadBalancer.Ingress {
+			addr, err := netip.ParseAddr(ingress.IP)
+			if err != nil {
+				continue
+			}
+			prefix, ok := config.prefixOf(addr)
+			if ok && !slices.Contains(subnets[prefix], recorded) {
+				subnets[prefix] = append(subnets[prefix], recorded)
+			}
+		}
+	}
+	for _, nodes := range subnets {
+		slices.Sort(nodes)
+	}
+	return subnets
+}
+
+func (d *driftController) sync(ctx context.Context, service *v1.Service, nodes []*v1.Node, owners map[netip.Prefix]string, subnets map[netip.Prefix][]string) error {
+	config := d.cloud.config()
+	recorded := service.Labels[serviceNode]
+	drifts := []drift{}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		addr, err := netip.ParseAddr(ingress.IP)
+		if err != nil {
+			continue
+		}
+		/* unmanaged failover IPs are moved away on reload */
+		prefix, ok := config.prefixOf(addr)
+		if !ok {
+			continue
+		}
+		owner := owners[prefix]
+		if owner == recorded {
+			continue
+		}
+		if shared := subnets[prefix]; len(shared) > 1 {
+			names := strings.Join(shared, "', '")
+			klog.Warningf("Not repairing drift of failover IP '%s' of service '%s', services sharing subnet '%s' are recorded on nodes '%s'", ingress.IP, serviceKey(service), prefix, names)
+			d.cloud.events.Eventf(service, v1.EventTypeWarning, eventReasonDriftConflict,
+				"Failover IP '%s' is not repaired, services sharing subnet '%s' are recorded on nodes '%s'", ingress.IP, prefix, names)
+			continue
+		}
+		drifts = append(drifts, drift{ingress.IP, prefix, owner})
+	}
+	if len(drifts) == 0 {
+		return nil
+	}
+	for _, drift := range drifts {
+		owner := drift.owner
+		if owner == "" {
+			owner = "<none>"
+		}
+		klog.Warningf("Failover IP '%s' of service '%s' is routed to '%s' instead of node '%s'", drift.ip, serviceKey(service), owner, recorded)
+		d.cloud.events.Eventf(service, v1.EventTypeWarning, eventReasonDriftDetected,
+			"Failover IP '%s' is routed to '%s' instead of node '%s'", drift.ip, owner, recorded)
+	}
+
+	/* serialize with the controllers ensuring the loadbalancer */
+	unlock := d.cloud.services.lock(serviceKey(service))
+	defer unlock()
+	if d.config.Authoritative == driftAuthoritativeSCP {
+		if node := d.adoptable(service, drifts, nodes, config); node != nil {
+			changed, err := d.changed(ctx, service)
+			if err != nil || changed {
+				return err
+			}
+			return d.adopt(service, node, drifts)
+		}
+	}
+	node, ok := nodeObject(recorded, nodes).(*v1.Node)
+	if !ok || !config.Nodes.isEligible(node) {
+		/* the drain controller moves the service away */
+		klog.Infof("Not routing failover IPs of service '%s' back to ineligible node '%s'", serviceKey(service), recorded)
+		return nil
+	}
+	lb := newLoadBalancers(d.cloud)
+	for _, drift := range drifts {
+		if d.cloud.dryRun(service, "would route failover IP '%s' back to node '%s' (%s)", drift.ip, recorded, rerouteReasonDrift) {
+			continue
+		}
+		/* services sharing the prefix are moved along under its lock */
+		unlockSubnet := d.cloud.subnets.lock(drift.prefix.String())
+		changed, err := d.changed(ctx, service)
+		if err == nil && !changed {
+			err = d.cloud.routeToServer(ctx, drift.prefix, recorded)
+		}
+		unlockSubnet()
+		if changed {
+			return nil
+		}
+		if err != nil {
+			rerouteFailures.WithLabelValues(drift.ip, rerouteReasonDrift).Inc()
+			lb.rerouteFailed(service, node, drift.ip, err.Error())
+			return err
+		}
+		/* other services may share the prefix */
+		owners[drift.prefix] = recorded
+		klog.Infof("Routed failover IP '%s' back to node '%s' for service '%s'", drift.ip, recorded, serviceKey(service))
+		reroutes.WithLabelValues(drift.ip, rerouteReasonDrift).Inc()
+		setIPOwner(drift.ip, recorded)
+		lb.rerouted(service, node, nodes, drift.ip, rerouteReasonDrift)
+	}
+	return nil
+}
+
+// changed reports whether the service was changed since it was listed,
+// e.g. moved by another controller while SCP was queried. Its drift is
+// checked again next time instead.
+func (d *driftController) changed(ctx context.Context, service *v1.Service) (bool, error) {
+	latest, err := d.cloud.client.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	if latest.ResourceVersion != service.ResourceVersion || latest.Labels[serviceNode] != service.Labels[serviceNode] {
+		klog.Infof("Service '%s' changed during drift detection, checking it again later", serviceKey(service))
+		return true, nil
+	}
+	return false, nil
+}
+
+// adoptable returns the node SCP routes all failover IPs of the service to,
+// if that is an eligible node.
+func (d *driftController) adoptable(service *v1.Service, drifts []drift, nodes []*v1.Node, config *Config) *v1.Node {
+	if len(drifts) != len(service.Status.LoadBalancer.Ingress) {
+		return nil
+	}
+	owner := drifts[0].owner
+	for _, drift := range drifts {
+		if drift.owner != owner {
+			return nil
+		}
+	}
+	node, ok := nodeObject(owner, nodes).(*v1.Node)
+	if !ok || !config.Nodes.isEligible(node) {
+		return nil
+	}
+	return node
+}
+
+// adopt records the node SCP routes the failover IPs to on the service and
+// moves the node label, keeping the IPs.
+func (d *driftController) adopt(service *v1.Service, node *v1.Node, drifts []drift) error {
+	klog.Infof("Recording node '%s' for service '%s' as routed by SCP", node.Name, serviceKey(service))
+	err := d.cloud.removeServiceNode(service, false)
+	if err != nil {
+		klog.Warningf("Failed to remove service '%s' from node '%s': %v", serviceKey(service), service.Labels[serviceNode], err)
+	}
+	err = d.cloud.updateServiceNode(service, node, service.Status.LoadBalancer.Ingress)
+	if err != nil {
+		return err
+	}
+	for _, drift := range drifts {
+		setIPOwner(drift.ip, node.Name)
+	}
+	return nil
+}
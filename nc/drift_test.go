@@ -0,0 +1,172 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func newDriftedTestCloud(t *testing.T, authoritative string) (*cloud, *driftController) {
+	t.Helper()
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, server := newTestCloud(t, Config{
+		Failover: []string{prefix.String()},
+		Cache:    CacheConfig{TTL: -1},
+		Drift:    DriftConfig{Authoritative: authoritative},
+	}, newTestNode("node-a", true), newTestNode("node-b", true))
+	ctx := context.Background()
+	core := cloud.client.CoreV1()
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := core.Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.Status.LoadBalancer = *status
+	_, err = core.Services("default").UpdateStatus(ctx, service, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* move the failover IP like the SCP web UI would */
+	recorded := service.Labels[serviceNode]
+	moved := "node-a"
+	if recorded == moved {
+		moved = "node-b"
+	}
+	server.Route(prefix, moved)
+	return cloud, newDriftController(cloud)
+}
+
+func TestDriftKubernetesAuthoritative(t *testing.T) {
+	cloud, drift := newDriftedTestCloud(t, driftAuthoritativeKubernetes)
+	ctx := context.Background()
+
+	drift.reconcile(ctx)
+	service, err := cloud.client.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners, err := cloud.ipOwners(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := owners[netip.MustParsePrefix("203.0.113.10/32")]; owner != service.Labels[serviceNode] {
+		t.Errorf("failover IP routed to '%s', not back to '%s'", owner, service.Labels[serviceNode])
+	}
+}
+
+func TestDriftSCPAuthoritative(t *testing.T) {
+	cloud, drift := newDriftedTestCloud(t, driftAuthoritativeSCP)
+	ctx := context.Background()
+
+	owners, err := cloud.ipOwners(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := owners[netip.MustParsePrefix("203.0.113.10/32")]
+	drift.reconcile(ctx)
+	service, err := cloud.client.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Labels[serviceNode] != owner {
+		t.Errorf("service recorded on node '%s', want '%s'", service.Labels[serviceNode], owner)
+	}
+	node, err := cloud.client.CoreV1().Nodes().Get(ctx, owner, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Labels[nodeService+"web"] != "true" {
+		t.Errorf("node '%s' is missing the service label", owner)
+	}
+}
+
+func TestDriftServiceChanged(t *testing.T) {
+	cloud, drift := newDriftedTestCloud(t, driftAuthoritativeKubernetes)
+	ctx := context.Background()
+	core := cloud.client.CoreV1()
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+
+	services, err := core.Services("").List(ctx, metav1.ListOptions{LabelSelector: serviceNode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := core.Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := []*v1.Node{&nodes.Items[0], &nodes.Items[1]}
+	owners, err := cloud.ipOwners(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := owners[prefix]
+
+	/* another controller records the node while SCP is queried */
+	service := services.Items[0].DeepCopy()
+	service.Labels[serviceNode] = moved
+	_, err = core.Services("default").Update(ctx, service, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = drift.sync(ctx, &services.Items[0], candidates, owners, drift.subnets(services.Items))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners, err = cloud.ipOwners(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := owners[prefix]; owner != moved {
+		t.Errorf("failover IP routed back to '%s' after the service changed", owner)
+	}
+}
+
+func TestDriftSharedSubnetConflict(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.8/29")
+	web := newTestService("web", nil)
+	web.Labels = map[string]string{serviceNode: "node-a"}
+	web.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "203.0.113.8"}}
+	api := newTestService("api", nil)
+	api.Labels = map[string]string{serviceNode: "node-b"}
+	api.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "203.0.113.9"}}
+	cloud, server := newTestCloud(t, Config{
+		Failover: []string{prefix.String()},
+		Cache:    CacheConfig{TTL: -1},
+	}, newTestNode("node-a", true), newTestNode("node-b", true), web, api)
+	server.Route(prefix, "node-b")
+	events := cloud.events.(*record.FakeRecorder).Events
+
+	newDriftController(cloud).reconcile(context.Background())
+	if owner := server.Owner(prefix); owner != "node-b" {
+		t.Errorf("subnet shared by services on different nodes moved to '%s'", owner)
+	}
+	if event := <-events; !strings.HasPrefix(event, "Warning DriftConflict") {
+		t.Errorf("unexpected event: %s", event)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// localSelector restricts services with externalTrafficPolicy Local to the
+// nodes running ready endpoints, since other nodes would drop the traffic.
+// Without any ready endpoints, e.g. during a rollout, services stay on
+// their current node.
+type localSelector struct {
+	client kubernetes.Interface
+}
+
+func (l localSelector) Select(ctx context.Context, service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	if service.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyLocal {
+		return nodes, nil
+	}
+	endpoints, err := endpointNodes(ctx, l.client, service)
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) == 0 {
+		nodeName, ok := service.Labels[serviceNode]
+		if !ok || !slices.ContainsFunc(nodes, func(node *v1.Node) bool { return node.Name == nodeName }) {
+			return nodes, nil
+		}
+		endpoints[nodeName] = true
+	}
+	return slices.DeleteFunc(nodes, func(node *v1.Node) bool {
+		return !endpoints[node.Name]
+	}), nil
+}
+
+// endpointsController watches the EndpointSlices of services with
+// externalTrafficPolicy Local and moves their failover IPs once the
+// endpoints migrated away from the node the IPs are routed to.
+type endpointsController struct {
+	cloud *cloud
+	queue workqueue.TypedRateLimitingInterface[types.NamespacedName]
+}
+
+func newEndpointsController(cloud *cloud) *endpointsController {
+	return &endpointsController{
+		cloud: cloud,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[types.NamespacedName](),
+			workqueue.TypedRateLimitingQueueConfig[types.NamespacedName]{Name: "nc-failover-endpoints"},
+		),
+	}
+}
+
+func (e *endpointsController) Run(ctx context.Context) {
+	defer e.queue.ShutDown()
+
+	factory := informers.NewSharedInformerFactory(e.cloud.client, 10*time.Minute)
+	informer := factory.Discovery().V1().EndpointSlices().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    e.enqueue,
+		UpdateFunc: func(_, obj interface{}) { e.enqueue(obj) },
+		DeleteFunc: e.enqueue,
+	})
+	if err != nil {
+		klog.Errorf("Failed to watch endpoint slices: %v", err)
+		return
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+
+	klog.Infof("Starting endpoints controller")
+	go wait.UntilWithContext(ctx, e.worker, time.Second)
+	<-ctx.Done()
+}
+
+func (e *endpointsController) enqueue(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	name, ok := slice.Labels[discoveryv1.LabelServiceName]
+	if !ok {
+		return
+	}
+	e.queue.Add(types.NamespacedName{Namespace: slice.Namespace, Name: name})
+}
+
+func (e *endpointsController) worker(ctx context.Context) {
+	for e.processNext(ctx) {
+	}
+}
+
+func (e *endpointsController) processNext(ctx context.Context) bool {
+	key, quit := e.queue.Get()
+	if quit {
+		return false
+	}
+	defer e.queue.Done(key)
+
+	err := e.sync(ctx, key)
+	if err != nil {
+		klog.Errorf("Failed to sync endpoints of service '%s': %v", key, err)
+		e.queue.AddRateLimited(key)
+		return true
+	}
+	e.queue.Forget(key)
+	return true
+}
+
+func (e *endpointsController) sync(ctx context.Context, key types.NamespacedName) error {
+	core := e.cloud.client.CoreV1()
+	service, err := core.Services(key.Namespace).Get(ctx, key.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer || service.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyLocal {
+		return nil
+	}
+	nodeName, ok := service.Labels[serviceNode]
+	if !ok {
+		return nil
+	}
+	endpoints, err := endpointNodes(ctx, e.cloud.client, service)
+	if err != nil {
+		return err
+	}
+	if endpoints[nodeName] || len(endpoints) == 0 {
+		return nil
+	}
+
+	klog.Infof("Endpoints of service '%s' migrated away from node '%s'", key, nodeName)
+	nodes, err := core.Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	candidates := make([]*v1.Node, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		candidates = append(candidates, &nodes.Items[i])
+	}
+	ctx = withFailover(ctx, rerouteReasonEndpoints, time.Time{})
+	_, err = newLoadBalancers(e.cloud).EnsureLoadBalancer(ctx, "", service, candidates)
+	return err
+}
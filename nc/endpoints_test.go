@@ -0,0 +1,65 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLocalSelector(t *testing.T) {
+	nodeName := "node-b"
+	client := fake.NewSimpleClientset()
+	selector := localSelector{client}
+	service := newTestService("web", nil)
+	service.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyLocal
+	service.Labels = map[string]string{serviceNode: "node-a"}
+	nodes := []*v1.Node{newTestNode("node-a", true), newTestNode("node-b", true)}
+	ctx := context.Background()
+
+	/* no ready endpoints during a rollout */
+	candidates, err := selector.Select(ctx, service, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].Name != "node-a" {
+		t.Errorf("service without endpoints not kept on its node: %v", candidates)
+	}
+
+	_, err = client.DiscoveryV1().EndpointSlices("default").Create(ctx, &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "web-1",
+			Labels: map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		Endpoints: []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}, NodeName: &nodeName}},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates, err = selector.Select(ctx, service, []*v1.Node{newTestNode("node-a", true), newTestNode("node-b", true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].Name != "node-b" {
+		t.Errorf("service not restricted to the node with endpoints: %v", candidates)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"fmt"
+	"slices"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	eventReasonRerouted              = "Rerouted"
+	eventReasonRerouteFailed         = "RerouteFailed"
+	eventReasonNoFailoverIPAvailable = "NoFailoverIPAvailable"
+	eventReasonNodeOffline           = "NodeOffline"
+	eventReasonDryRun                = "DryRun"
+	eventReasonAuthenticationFailed  = "AuthenticationFailed"
+	eventReasonAuthenticated         = "Authenticated"
+	eventReasonDriftDetected         = "DriftDetected"
+	eventReasonDriftConflict         = "DriftConflict"
+)
+
+// newEventRecorder returns a recorder emitting Events via the API server
+// until stop is closed.
+func newEventRecorder(client kubernetes.Interface, stop <-chan struct{}) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartStructuredLogging(0)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	go func() { <-stop; broadcaster.Shutdown() }()
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: providerName + "-failover-ccm"})
+}
+
+// dryRun reports whether changes are disabled, in which case it logs and
+// records an Event on object about the change that would have been made.
+func (c *cloud) dryRun(object runtime.Object, format string, args ...any) bool {
+	if !c.config().DryRun {
+		return false
+	}
+	message := fmt.Sprintf(format, args...)
+	klog.Infof("Dry-run: %s", message)
+	if object != nil {
+		c.events.Event(object, v1.EventTypeNormal, eventReasonDryRun, message)
+	}
+	return true
+}
+
+// nodeObject returns the node with the given name from nodes, or a bare
+// reference to it if it is not part of nodes anymore.
+func nodeObject(name string, nodes []*v1.Node) runtime.Object {
+	if index := slices.IndexFunc(nodes, func(node *v1.Node) bool { return node.Name == name }); index >= 0 {
+		return nodes[index]
+	}
+	return &v1.ObjectReference{Kind: "Node", Name: name}
+}
@@ -0,0 +1,343 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"maps"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	healthProbeKubelet = "kubelet"
+	healthProbeService = "service"
+
+	defaultKubeletPort = 10250
+	healthCheckPath    = "/healthz"
+)
+
+type HealthConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	Probe            string        `yaml:"probe"`
+	Path             string        `yaml:"path"`
+	Interval         time.Duration `yaml:"interval"`
+	Timeout          time.Duration `yaml:"timeout"`
+	FailureThreshold int           `yaml:"failureThreshold"`
+	SuccessThreshold int           `yaml:"successThreshold"`
+	Cooldown         time.Duration `yaml:"cooldown"`
+}
+
+func (h *HealthConfig) Initialize(path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if h.Probe == "" {
+		h.Probe = healthProbeKubelet
+	}
+	if h.Probe != healthProbeKubelet && h.Probe != healthProbeService {
+		errs = append(errs, field.NotSupported(path.Child("probe"), h.Probe, []string{healthProbeKubelet, healthProbeService}))
+	}
+	if h.Interval <= 0 {
+		h.Interval = 5 * time.Second
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = 2 * time.Second
+	}
+	if h.FailureThreshold <= 0 {
+		h.FailureThreshold = 3
+	}
+	if h.SuccessThreshold <= 0 {
+		h.SuccessThreshold = 2
+	}
+	if h.Cooldown <= 0 {
+		h.Cooldown = 30 * time.Second
+	}
+	return errs
+}
+
+// healthController actively probes the nodes owning failover IPs, or the
+// services on them, and moves the IPs away once a node or service failed
+// FailureThreshold probes in a row. It only becomes healthy again after
+// SuccessThreshold probes in a row succeeded, and a service is moved at
+// most once per Cooldown. Unhealthy nodes do not receive failover IPs, and
+// a service is only moved to nodes it passes its probes on.
+type healthController struct {
+	cloud     *cloud
+	config    *HealthConfig
+	failures  map[string]int
+	successes map[string]int
+	unhealthy map[string]time.Time
+	moved     map[string]time.Time
+}
+
+func newHealthController(cloud *cloud) *healthController {
+	return &healthController{
+		cloud:     cloud,
+		config:    &cloud.config().Health,
+		failures:  make(map[string]int),
+		successes: make(map[string]int),
+		unhealthy: make(map[string]time.Time),
+		moved:     make(map[string]time.Time),
+	}
+}
+
+func (h *healthController) Run(ctx context.Context) {
+	klog.Infof("Starting health controller with '%s' probe every %s", h.config.Probe, h.config.Interval)
+	wait.UntilWithContext(ctx, h.reconcile, h.config.Interval)
+}
+
+func (h *healthController) reconcile(ctx context.Context) {
+	core := h.cloud.client.CoreV1()
+	opts := metav1.ListOptions{LabelSelector: serviceNode}
+	services, err := core.Services("").List(ctx, opts)
+	if err != nil {
+		klog.Errorf("Failed to list services for health probes: %v", err)
+		return
+	}
+	nodes, err := core.Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Failed to list nodes for health probes: %v", err)
+		return
+	}
+
+	nodesByName := make(map[string]*v1.Node)
+	for i := range nodes.Items {
+		nodesByName[nodes.Items[i].Name] = &nodes.Items[i]
+	}
+	h.prune(services.Items, nodesByName)
+
+	if h.config.Probe == healthProbeKubelet {
+		for name, node := range nodesByName {
+			h.record(name, h.probeKubelet(ctx, node))
+		}
+		h.cloud.unhealthy.update(h.unhealthy)
+	} else {
+		for i := range services.Items {
+			node, ok := nodesByName[services.Items[i].Labels[serviceNode]]
+			if !ok {
+				/* the drain controller moves the service away */
+				continue
+			}
+			h.record(serviceKey(&services.Items[i]), h.probeService(ctx, &services.Items[i], node))
+		}
+	}
+
+	lb := newLoadBalancers(h.cloud)
+	for i := range services.Items {
+		service := &services.Items[i]
+		key := serviceKey(service)
+		name := service.Labels[serviceNode]
+		since, ok := h.unhealthy[name]
+		if h.config.Probe == healthProbeService {
+			since, ok = h.unhealthy[key]
+		}
+		if !ok {
+			continue
+		}
+		if time.Since(h.moved[key]) < h.config.Cooldown {
+			klog.Infof("Delaying failover of service '%s' away from unhealthy node '%s'", key, name)
+			continue
+		}
+		candidates := []*v1.Node{}
+		for _, node := range nodesByName {
+			if _, ok := h.unhealthy[node.Name]; ok || node.Name == name {
+				continue
+			}
+			/* an application failing everywhere must not flap between nodes */
+			if h.config.Probe == healthProbeService && !h.probeService(ctx, service, node) {
+				continue
+			}
+			candidates = append(candidates, node)
+		}
+		if len(candidates) == 0 {
+			klog.Warningf("Not moving service '%s' away from unhealthy node '%s', no other node is healthy", key, name)
+			continue
+		}
+		h.moved[key] = time.Now()
+		klog.Warningf("Moving service '%s' away from unhealthy node '%s'", key, name)
+		_, err := lb.EnsureLoadBalancer(withFailover(ctx, rerouteReasonUnhealthy, since), "", service, candidates)
+		if err != nil {
+			klog.Errorf("Failed to move service '%s' away from unhealthy node '%s': %v", key, name, err)
+		} else if h.config.Probe == healthProbeService {
+			/* probe the service on its new node from scratch */
+			h.forget(key)
+		}
+	}
+}
+
+// prune forgets the services and nodes which are gone, and the services
+// whose cooldown passed.
+func (h *healthController) prune(services []v1.Service, nodes map[string]*v1.Node) {
+	current := make(map[string]bool, len(services)+len(nodes))
+	for i := range services {
+		current[serviceKey(&services[i])] = true
+	}
+	for name := range nodes {
+		current[name] = true
+	}
+	for name := range h.failures {
+		if !current[name] {
+			h.forget(name)
+		}
+	}
+	for name := range h.unhealthy {
+		if !current[name] {
+			h.forget(name)
+		}
+	}
+	for key, moved := range h.moved {
+		if !current[key] || time.Since(moved) >= h.config.Cooldown {
+			delete(h.moved, key)
+		}
+	}
+}
+
+func (h *healthController) forget(name string) {
+	delete(h.failures, name)
+	delete(h.successes, name)
+	delete(h.unhealthy, name)
+}
+
+func (h *healthController) record(name string, healthy bool) {
+	subject := "Node"
+	if h.config.Probe == healthProbeService {
+		subject = "Service"
+	}
+	if healthy {
+		h.failures[name] = 0
+		h.successes[name]++
+		if _, ok := h.unhealthy[name]; ok && h.successes[name] >= h.config.SuccessThreshold {
+			klog.Infof("%s '%s' passed %d health probes and is healthy again", subject, name, h.successes[name])
+			delete(h.unhealthy, name)
+		}
+	} else {
+		h.successes[name] = 0
+		h.failures[name]++
+		if _, ok := h.unhealthy[name]; !ok && h.failures[name] >= h.config.FailureThreshold {
+			klog.Warningf("%s '%s' failed %d health probes and is unhealthy", subject, name, h.failures[name])
+			h.unhealthy[name] = time.Now()
+		}
+	}
+}
+
+// unhealthyNodes are the nodes the health controller found unhealthy,
+// which do not receive failover IPs.
+type unhealthyNodes struct {
+	mutex sync.RWMutex
+	nodes map[string]time.Time
+}
+
+func (u *unhealthyNodes) update(nodes map[string]time.Time) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.nodes = maps.Clone(nodes)
+}
+
+func (u *unhealthyNodes) contains(name string) bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	_, ok := u.nodes[name]
+	return ok
+}
+
+// probeAddress returns the own address of the node to probe.
+func probeAddress(node *v1.Node) (string, bool) {
+	for _, addrType := range []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP} {
+		for _, address := range node.Status.Addresses {
+			if address.Type == addrType {
+				return address.Address, true
+			}
+		}
+	}
+	klog.Warningf("Node '%s' has no address to probe", node.Name)
+	return "", false
+}
+
+func (h *healthController) probeKubelet(ctx context.Context, node *v1.Node) bool {
+	port := int(node.Status.DaemonEndpoints.KubeletEndpoint.Port)
+	if port == 0 {
+		port = defaultKubeletPort
+	}
+	address, ok := probeAddress(node)
+	if !ok {
+		return false
+	}
+	return h.probeTCP(ctx, address, port)
+}
+
+// probeService probes the service on the own address of the node owning its
+// failover IPs, as kube-proxy intercepts connections to the failover IPs
+// locally. Services with a health check node port are probed on it, which
+// fails if the node has no local endpoints.
+func (h *healthController) probeService(ctx context.Context, service *v1.Service, node *v1.Node) bool {
+	address, ok := probeAddress(node)
+	if !ok {
+		return false
+	}
+	if port := int(service.Spec.HealthCheckNodePort); port != 0 {
+		return h.probeHTTP(ctx, address, port, healthCheckPath)
+	}
+	for _, port := range service.Spec.Ports {
+		if port.NodePort == 0 || (port.Protocol != "" && port.Protocol != v1.ProtocolTCP) {
+			continue
+		}
+		if h.config.Path != "" {
+			if !h.probeHTTP(ctx, address, int(port.NodePort), h.config.Path) {
+				return false
+			}
+		} else if !h.probeTCP(ctx, address, int(port.NodePort)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *healthController) probeTCP(ctx context.Context, host string, port int) bool {
+	dialer := net.Dialer{Timeout: h.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		klog.V(2).Infof("Health probe of '%s' port %d failed: %v", host, port, err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (h *healthController) probeHTTP(ctx context.Context, host string, port int, path string) bool {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+	url := "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		klog.V(2).Infof("Health probe of '%s' failed: %v", url, err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHealthThresholds(t *testing.T) {
+	cloud, _ := newTestCloud(t, Config{
+		Failover: []string{"203.0.113.10/32"},
+		Health:   HealthConfig{FailureThreshold: 3, SuccessThreshold: 2},
+	})
+	health := newHealthController(cloud)
+
+	health.record("node-a", false)
+	health.record("node-a", false)
+	health.record("node-a", true)
+	health.record("node-a", false)
+	health.record("node-a", false)
+	if _, ok := health.unhealthy["node-a"]; ok {
+		t.Error("node unhealthy without failing probes in a row")
+	}
+	health.record("node-a", false)
+	if _, ok := health.unhealthy["node-a"]; !ok {
+		t.Error("node healthy after failing probes in a row")
+	}
+
+	health.record("node-a", true)
+	health.record("node-a", false)
+	health.record("node-a", true)
+	if _, ok := health.unhealthy["node-a"]; !ok {
+		t.Error("node healthy again without passing probes in a row")
+	}
+	health.record("node-a", true)
+	if _, ok := health.unhealthy["node-a"]; ok {
+		t.Error("node unhealthy after passing probes in a row")
+	}
+}
+
+func TestHealthCooldown(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, server := newTestCloud(t, Config{
+		Failover: []string{prefix.String()},
+		Health:   HealthConfig{Probe: healthProbeKubelet, Cooldown: time.Minute},
+	}, newTestNode("node-a", true), newTestNode("node-b", true))
+	health := newHealthController(cloud)
+	ctx := context.Background()
+
+	_, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unhealthy := server.Owner(prefix)
+	health.unhealthy[unhealthy] = time.Now()
+
+	/* the service was just moved */
+	health.moved["default/web"] = time.Now()
+	health.reconcile(ctx)
+	if owner := server.Owner(prefix); owner != unhealthy {
+		t.Errorf("failover IP moved to '%s' during cooldown", owner)
+	}
+
+	health.moved["default/web"] = time.Now().Add(-time.Minute)
+	health.moved["default/gone"] = time.Now()
+	health.reconcile(ctx)
+	if owner := server.Owner(prefix); owner == unhealthy {
+		t.Errorf("failover IP not moved away from unhealthy node '%s'", owner)
+	}
+	if _, ok := health.moved["default/gone"]; ok {
+		t.Error("cooldown of deleted service not pruned")
+	}
+}
+
+func TestHealthUnhealthyNodeSkipped(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, server := newTestCloud(t, Config{Failover: []string{prefix.String()}},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+	cloud.unhealthy.update(map[string]time.Time{"node-a": time.Now()})
+
+	_, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := server.Owner(prefix); owner != "node-b" {
+		t.Errorf("failover IP routed to unhealthy node '%s'", owner)
+	}
+}
+
+func TestHealthServiceProbe(t *testing.T) {
+	/* only node-b runs the service on its node port */
+	listener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("cannot listen on second loopback address: %v", err)
+	}
+	nodePort := listener.Addr().(*net.TCPAddr).Port
+	nodeA := newTestNode("node-a", true)
+	nodeA.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "127.0.0.1"}}
+	nodeB := newTestNode("node-b", true)
+	nodeB.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "127.0.0.2"}}
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, server := newTestCloud(t, Config{
+		Failover: []string{prefix.String()},
+		Health:   HealthConfig{Probe: healthProbeService, FailureThreshold: 1, Cooldown: time.Nanosecond},
+	}, nodeA, nodeB)
+	health := newHealthController(cloud)
+	ctx := context.Background()
+
+	_, err = ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := cloud.client.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.Spec.Ports = []v1.ServicePort{{Port: 80, NodePort: int32(nodePort)}}
+	_, err = cloud.client.CoreV1().Services("default").Update(ctx, service, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health.reconcile(ctx)
+	if owner := server.Owner(prefix); owner != "node-b" {
+		t.Errorf("failover IP routed to '%s', want 'node-b' passing the probe", owner)
+	}
+	if _, ok := health.unhealthy["node-a"]; ok {
+		t.Error("node marked unhealthy by a service probe")
+	}
+
+	/* an application failing everywhere stays where it is */
+	listener.Close()
+	health.reconcile(ctx)
+	health.reconcile(ctx)
+	if owner := server.Owner(prefix); owner != "node-b" {
+		t.Errorf("failover IP of service failing on all nodes moved to '%s'", owner)
+	}
+}
+
+func TestHealthProbeServiceNode(t *testing.T) {
+	cloud, _ := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}})
+	health := newHealthController(cloud)
+	var unhealthy atomic.Bool
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unhealthy.Load() || r.URL.Path != healthCheckPath {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(probe.Close)
+	host, port, err := net.SplitHostPort(probe.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodePort, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := newTestNode("node-a", true)
+	node.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: host}}
+	service := newTestService("web", nil)
+	service.Spec.HealthCheckNodePort = int32(nodePort)
+	/* probing the failover IP itself would be intercepted by kube-proxy */
+	service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "203.0.113.10"}}
+
+	ctx := context.Background()
+	if !health.probeService(ctx, service, node) {
+		t.Error("service probe failed on node with local endpoints")
+	}
+	unhealthy.Store(true)
+	if health.probeService(ctx, service, node) {
+		t.Error("service probe passed on node without local endpoints")
+	}
+
+	unhealthy.Store(false)
+	service.Spec.HealthCheckNodePort = 0
+	service.Spec.Ports = []v1.ServicePort{{Port: 80, NodePort: int32(nodePort)}}
+	if !health.probeService(ctx, service, node) {
+		t.Error("service probe failed on node port")
+	}
+	node.Status.Addresses = nil
+	if health.probeService(ctx, service, node) {
+		t.Error("service probe passed on node without address")
+	}
+}
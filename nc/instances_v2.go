@@ -18,6 +18,7 @@ package nc
 
 import (
 	"context"
+	"errors"
 	"net/netip"
 	"slices"
 	"strings"
@@ -43,6 +44,9 @@ func newInstancesV2(cloud *cloud) *instancesV2 {
 }
 
 func (i *instancesV2) InstanceExists(ctx context.Context, node *v1.Node) (bool, error) {
+	if err := i.cloud.initialized(); err != nil {
+		return false, err
+	}
 	klog.Infof("Checking if server '%s' exists", node.Name)
 	resp, err := i.cloud.getServers(ctx)
 	if err != nil {
@@ -59,6 +63,9 @@ func (i *instancesV2) InstanceExists(ctx context.Context, node *v1.Node) (bool,
 }
 
 func (i *instancesV2) InstanceShutdown(ctx context.Context, node *v1.Node) (bool, error) {
+	if err := i.cloud.initialized(); err != nil {
+		return false, err
+	}
 	klog.Infof("Checking if server '%s' is shutdown", node.Name)
 	resp, err := i.cloud.getServerState(ctx, node.Name)
 	if err != nil {
@@ -66,29 +73,35 @@ func (i *instancesV2) InstanceShutdown(ctx context.Context, node *v1.Node) (bool
 	}
 	klog.Infof("Server '%s' is '%s'", node.Name, resp.Return_)
 	if resp.Return_ == serverStateOffline {
+		i.cloud.events.Eventf(node, v1.EventTypeWarning, eventReasonNodeOffline,
+			"vServer '%s' is offline", node.Name)
 		return true, i.handleShutdown(ctx, node)
 	}
 	return false, nil
 }
 
 func (i *instancesV2) InstanceMetadata(ctx context.Context, node *v1.Node) (*cloudprovider.InstanceMetadata, error) {
+	if err := i.cloud.initialized(); err != nil {
+		return nil, err
+	}
 	klog.Infof("Querying information for server '%s'", node.Name)
 	resp, err := i.cloud.getServerInfo(ctx, node.Name)
+	if errors.Is(err, ErrUnknownServer) {
+		return nil, cloudprovider.InstanceNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 	addresses := node.Status.Addresses
 	for _, ip := range resp.Return_.Ips {
-		if strings.ContainsRune(*ip, '/') {
-			// Strip CIDR notation if present
-			*ip, _, _ = strings.Cut(*ip, "/")
-		}
-		addr, err := netip.ParseAddr(*ip)
+		// Strip CIDR notation if present, without modifying the cached response
+		ip, _, _ := strings.Cut(*ip, "/")
+		addr, err := netip.ParseAddr(ip)
 		if err != nil {
 			return nil, err
 		}
-		if i.cloud.config.IsFailoverIP(addr) {
-			klog.Infof("Skipping node '%s' failover IP: %s", node.Name, *ip)
+		if i.cloud.config().IsFailoverIP(addr) {
+			klog.Infof("Skipping node '%s' failover IP: %s", node.Name, ip)
 			continue
 		}
 		address := v1.NodeAddress{
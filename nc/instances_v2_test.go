@@ -0,0 +1,102 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/mback2k/nc-failover-ccm/nc/scp/scptest"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestInstanceExists(t *testing.T) {
+	cloud, _ := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}})
+	instances := newInstancesV2(cloud)
+
+	for name, want := range map[string]bool{"node-a": true, "node-c": false} {
+		exists, err := instances.InstanceExists(context.Background(), newTestNode(name, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != want {
+			t.Errorf("InstanceExists(%s) = %v, want %v", name, exists, want)
+		}
+	}
+}
+
+func TestInstanceShutdown(t *testing.T) {
+	service := newTestService("web", map[string]string{serviceNode: "node-a"})
+	service.Labels = map[string]string{serviceNode: "node-a"}
+	node := newTestNode("node-a", false)
+	cloud, server := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}}, service, node)
+	instances := newInstancesV2(cloud)
+
+	shutdown, err := instances.InstanceShutdown(context.Background(), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shutdown {
+		t.Error("expected online server not to be shutdown")
+	}
+
+	server.SetState("node-a", scptest.StateOffline)
+	shutdown, err = instances.InstanceShutdown(context.Background(), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shutdown {
+		t.Error("expected offline server to be shutdown")
+	}
+
+	service, err = cloud.client.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := service.Labels[serviceNode]; ok {
+		t.Error("expected service to be removed from offline node")
+	}
+}
+
+func TestInstanceMetadata(t *testing.T) {
+	cloud, server := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}})
+	server.Route(netip.MustParsePrefix("203.0.113.10/32"), "node-a")
+	instances := newInstancesV2(cloud)
+
+	metadata, err := instances.InstanceMetadata(context.Background(), newTestNode("node-a", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.ProviderID != "nc://node-a" {
+		t.Errorf("unexpected provider ID: %s", metadata.ProviderID)
+	}
+	for _, ip := range []string{"192.0.2.10", "2001:db8:a::1"} {
+		address := v1.NodeAddress{Type: v1.NodeExternalIP, Address: ip}
+		if !slices.Contains(metadata.NodeAddresses, address) {
+			t.Errorf("missing external IP: %s", ip)
+		}
+	}
+	for _, address := range metadata.NodeAddresses {
+		if address.Address == "203.0.113.10" {
+			t.Error("failover IP must not be a node address")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mback2k/nc-failover-ccm/nc/scp"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const (
+	inventoryServers = "servers/"
+	inventoryInfo    = "info/"
+	inventoryIPs     = "ips/"
+)
+
+type CacheConfig struct {
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c *CacheConfig) Initialize(path *field.Path) field.ErrorList {
+	/* negative TTL disables caching */
+	if c.TTL == 0 {
+		c.TTL = 10 * time.Second
+	}
+	return nil
+}
+
+// inventory wraps scp.WSEndUser to cache the vServer list, information and
+// IPs for a TTL, but not the state which is needed to detect shutdowns.
+// Concurrent lookups of the same entry are coalesced into one SCP request,
+// and the information and IPs of all vServers are invalidated once a
+// failover IP was rerouted.
+type inventory struct {
+	scp.WSEndUser
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[string]*inventoryEntry
+}
+
+type inventoryEntry struct {
+	done    chan struct{}
+	value   any
+	err     error
+	expires time.Time
+}
+
+func newInventory(server scp.WSEndUser, ttl time.Duration) *inventory {
+	return &inventory{
+		WSEndUser: server,
+		ttl:       ttl,
+		entries:   make(map[string]*inventoryEntry),
+	}
+}
+
+func (i *inventory) GetVServersContext(ctx context.Context, request *scp.GetVServers) (*scp.GetVServersResponse, error) {
+	return lookup(ctx, i, inventoryServers+request.LoginName, func(ctx context.Context) (*scp.GetVServersResponse, error) {
+		return i.WSEndUser.GetVServersContext(ctx, request)
+	})
+}
+
+func (i *inventory) GetVServerInformationContext(ctx context.Context, request *scp.GetVServerInformation) (*scp.GetVServerInformationResponse, error) {
+	return lookup(ctx, i, inventoryInfo+request.LoginName+"/"+request.Vservername, func(ctx context.Context) (*scp.GetVServerInformationResponse, error) {
+		return i.WSEndUser.GetVServerInformationContext(ctx, request)
+	})
+}
+
+func (i *inventory) GetVServerIPsContext(ctx context.Context, request *scp.GetVServerIPs) (*scp.GetVServerIPsResponse, error) {
+	return lookup(ctx, i, inventoryIPs+request.LoginName+"/"+request.VserverName, func(ctx context.Context) (*scp.GetVServerIPsResponse, error) {
+		return i.WSEndUser.GetVServerIPsContext(ctx, request)
+	})
+}
+
+func (i *inventory) ChangeIPRoutingContext(ctx context.Context, request *scp.ChangeIPRouting) (*scp.ChangeIPRoutingResponse, error) {
+	/* invalidate even on errors, the route may have changed anyway */
+	defer i.invalidate(inventoryInfo+request.LoginName+"/", inventoryIPs+request.LoginName+"/")
+	return i.WSEndUser.ChangeIPRoutingContext(ctx, request)
+}
+
+// invalidate drops all entries with one of the given key prefixes.
+func (i *inventory) invalidate(prefixes ...string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	for key := range i.entries {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				delete(i.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// lookup returns the cached response for key, waits for a concurrent
+// lookup of it to finish or calls SCP. Errors are never cached. The call is
+// shared by all callers waiting for it, so it does not end with the context
+// of the caller starting it.
+func lookup[T any](ctx context.Context, i *inventory, key string, call func(context.Context) (T, error)) (T, error) {
+	var zero T
+	if i.ttl < 0 {
+		return call(ctx)
+	}
+
+	i.mutex.Lock()
+	entry, ok := i.entries[key]
+	if ok {
+		select {
+		case <-entry.done:
+			ok = entry.err == nil && time.Now().Before(entry.expires)
+		default:
+		}
+	}
+	if !ok {
+		entry = &inventoryEntry{done: make(chan struct{})}
+		i.entries[key] = entry
+		i.mutex.Unlock()
+
+		go func() {
+			entry.value, entry.err = call(context.WithoutCancel(ctx))
+			entry.expires = time.Now().Add(i.ttl)
+			if entry.err != nil {
+				i.mutex.Lock()
+				if i.entries[key] == entry {
+					delete(i.entries, key)
+				}
+				i.mutex.Unlock()
+			}
+			close(entry.done)
+		}()
+	} else {
+		i.mutex.Unlock()
+	}
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+	if entry.err != nil {
+		return zero, entry.err
+	}
+	return entry.value.(T), nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mback2k/nc-failover-ccm/nc/scp"
+)
+
+// blockingServer answers GetVServers once release is closed.
+type blockingServer struct {
+	scp.WSEndUser
+	release chan struct{}
+}
+
+func (b *blockingServer) GetVServersContext(ctx context.Context, request *scp.GetVServers) (*scp.GetVServersResponse, error) {
+	select {
+	case <-b.release:
+		return &scp.GetVServersResponse{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestInventoryCoalescesLookups(t *testing.T) {
+	cloud, server := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cloud.getServerIPs(context.Background(), "node-a")
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := server.Calls("getVServerIPs"); calls != 1 {
+		t.Errorf("getVServerIPs called %d times, want once", calls)
+	}
+}
+
+func TestInventoryCancelledLookup(t *testing.T) {
+	server := &blockingServer{release: make(chan struct{})}
+	inventory := newInventory(server, time.Minute)
+	request := &scp.GetVServers{LoginName: testUsername}
+
+	/* the caller starting the lookup gives up */
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan error)
+	go func() {
+		_, err := inventory.GetVServersContext(ctx, request)
+		started <- err
+	}()
+	waited := make(chan error)
+	go func() {
+		/* coalesced once the first lookup is registered */
+		for {
+			inventory.mutex.Lock()
+			_, ok := inventory.entries[inventoryServers+testUsername]
+			inventory.mutex.Unlock()
+			if ok {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		_, err := inventory.GetVServersContext(context.Background(), request)
+		waited <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-started; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled lookup, got: %v", err)
+	}
+	close(server.release)
+	if err := <-waited; err != nil {
+		t.Errorf("waiting lookup failed with the context of another caller: %v", err)
+	}
+}
+
+func TestInventoryInvalidatesOnReroute(t *testing.T) {
+	cloud, server := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}})
+
+	_, err := cloud.getServerIPs(context.Background(), "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cloud.routeServerIP(context.Background(), "203.0.113.10", "32", "node-a", "00:00:5e:00:53:0a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cloud.getServerIPs(context.Background(), "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := server.Calls("getVServerIPs"); calls != 2 {
+		t.Errorf("getVServerIPs called %d times, want twice", calls)
+	}
+	found := false
+	for _, ip := range resp.Return_ {
+		found = found || *ip == "203.0.113.10/32" || *ip == "203.0.113.10"
+	}
+	if !found {
+		t.Errorf("rerouted failover IP missing from %v", resp.Return_)
+	}
+}
+
+func TestInventoryDisabled(t *testing.T) {
+	cloud, server := newTestCloud(t, Config{
+		Failover: []string{"203.0.113.10/32"},
+		Cache:    CacheConfig{TTL: -1},
+	})
+
+	/* the login on initialization is not cached either */
+	login := server.Calls("getVServers")
+	for range 2 {
+		_, err := cloud.getServers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := server.Calls("getVServers") - login; calls != 2 {
+		t.Errorf("getVServers called %d times, want twice", calls)
+	}
+}
@@ -3,8 +3,10 @@ package nc
 import (
 	"context"
 	"errors"
+	"strings"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	nodeHelpers "k8s.io/cloud-provider/node/helpers"
 	serviceHelpers "k8s.io/cloud-provider/service/helpers"
@@ -14,11 +16,34 @@ import (
 const (
 	serviceNode = "k8s.mback2k.net/nc-failover-node"
 	nodeService = "nc-failover-service.k8s.mback2k.net/"
+	servicePool = "nc-failover.k8s.mback2k.net/pool"
+	serviceIPs  = "nc-failover.k8s.mback2k.net/loadbalancer-ips"
+
+	serviceNodeSelector = "nc-failover.k8s.mback2k.net/node-selector"
+
+	serviceAllocated = "nc-failover.k8s.mback2k.net/allocated-ips"
+
+	serviceCondition         = "nc-failover.k8s.mback2k.net/FailoverIPAssigned"
+	serviceConditionAssigned = "Assigned"
 )
 
-func (c *cloud) updateServiceNode(service *v1.Service, node *v1.Node) error {
+func (c *cloud) updateServiceNode(service *v1.Service, node *v1.Node, ingress []v1.LoadBalancerIngress) error {
+	allocated := make([]string, 0, len(ingress))
+	for _, ing := range ingress {
+		allocated = append(allocated, ing.IP)
+	}
+	if c.dryRun(service, "would assign failover IPs '%s' on node '%s'", strings.Join(allocated, ","), node.Name) {
+		return nil
+	}
 	changes := service.DeepCopy()
+	if changes.Annotations == nil {
+		changes.Annotations = make(map[string]string)
+	}
+	if changes.Labels == nil {
+		changes.Labels = make(map[string]string)
+	}
 	changes.Annotations[serviceNode] = node.Name
+	changes.Annotations[serviceAllocated] = strings.Join(allocated, ",")
 	changes.Labels[serviceNode] = node.Name
 	_, err := serviceHelpers.PatchService(c.client.CoreV1(), service, changes)
 	if err != nil {
@@ -35,6 +60,9 @@ func (c *cloud) updateServiceNode(service *v1.Service, node *v1.Node) error {
 
 func (c *cloud) removeServiceNode(service *v1.Service, clearStatus bool) error {
 	nodeName := service.Annotations[serviceNode]
+	if c.dryRun(service, "would remove service from node '%s'", nodeName) {
+		return nil
+	}
 	changes := service.DeepCopy()
 	if clearStatus {
 		changes.Status.LoadBalancer = v1.LoadBalancerStatus{}
@@ -57,3 +85,40 @@ func (c *cloud) removeServiceNode(service *v1.Service, clearStatus bool) error {
 	klog.Infof("Removed label '%s' from node '%s'", labelName, node.Name)
 	return nil
 }
+
+func (c *cloud) updateServiceCondition(service *v1.Service, status metav1.ConditionStatus, reason, message string) error {
+	if c.config().DryRun {
+		klog.V(2).Infof("Dry-run: would set condition '%s' of service '%s' to '%s'", reason, service.Name, status)
+		return nil
+	}
+	changes := service.DeepCopy()
+	changed := meta.SetStatusCondition(&changes.Status.Conditions, metav1.Condition{
+		Type:               serviceCondition,
+		Status:             status,
+		ObservedGeneration: service.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	if !changed {
+		return nil
+	}
+	_, err := serviceHelpers.PatchService(c.client.CoreV1(), service, changes)
+	return err
+}
+
+func (c *cloud) removeServiceIPs(service *v1.Service) error {
+	if _, ok := service.Annotations[serviceAllocated]; !ok {
+		return nil
+	}
+	if c.dryRun(service, "would release allocated failover IPs '%s'", service.Annotations[serviceAllocated]) {
+		return nil
+	}
+	changes := service.DeepCopy()
+	delete(changes.Annotations, serviceAllocated)
+	_, err := serviceHelpers.PatchService(c.client.CoreV1(), service, changes)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Removed allocated failover IPs from service '%s'", service.Name)
+	return nil
+}
@@ -18,13 +18,61 @@ package nc
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/netip"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mback2k/nc-failover-ccm/nc/scp"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 )
 
+var (
+	ErrNoFailoverIP = errors.New("no failover IP available")
+	ErrNoReadyNode  = errors.New("no ready node available")
+	ErrRouteRefused = errors.New("SCP refused to route failover IP")
+	ErrSubnetInUse  = errors.New("failover subnet is routed to another node for other services")
+)
+
+// AssignmentError is returned if no failover IP could be assigned to a
+// service, so that the service controller retries it with backoff. It
+// unwraps to one of the errors above.
+type AssignmentError struct {
+	Service string
+	Pool    string
+	kind    error
+}
+
+func (e *AssignmentError) Error() string {
+	if e.Pool != "" {
+		return fmt.Sprintf("failed to assign failover IP from pool '%s' to service '%s': %v", e.Pool, e.Service, e.kind)
+	}
+	return fmt.Sprintf("failed to assign failover IP to service '%s': %v", e.Service, e.kind)
+}
+
+func (e *AssignmentError) Unwrap() error {
+	return e.kind
+}
+
+// Reason returns the reason used for Events and the service condition.
+func (e *AssignmentError) Reason() string {
+	switch e.kind {
+	case ErrNoReadyNode:
+		return "NoReadyNode"
+	case ErrRouteRefused:
+		return "RouteRefused"
+	case ErrSubnetInUse:
+		return "SubnetInUse"
+	}
+	return eventReasonNoFailoverIPAvailable
+}
+
 type loadBalancers struct {
 	cloud *cloud
 }
@@ -34,10 +82,17 @@ func newLoadBalancers(cloud *cloud) *loadBalancers {
 }
 
 func (l *loadBalancers) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
+	if err := l.cloud.initialized(); err != nil {
+		return nil, false, err
+	}
 	klog.Infof("Querying loadbalancer status for service '%s'", service.Name)
 	if nodeName, ok := service.Labels[serviceNode]; ok {
 		klog.Infof("Found existing loadbalancer for service '%s' on node '%s'", service.Name, nodeName)
 		resp, err := l.cloud.getServerIPs(ctx, nodeName)
+		if errors.Is(err, ErrUnknownServer) {
+			klog.Warningf("Existing loadbalancer node '%s' for service '%s' is unknown", nodeName, service.Name)
+			return nil, false, nil
+		}
 		if err != nil {
 			return nil, false, err
 		}
@@ -52,12 +107,39 @@ func (l *loadBalancers) GetLoadBalancer(ctx context.Context, clusterName string,
 			}
 		}
 
+		err = l.cloud.alloc.sync(ctx, l.cloud.client)
+		if err != nil {
+			return nil, false, err
+		}
+
+		key := serviceKey(service)
+		pool := service.Annotations[servicePool]
+		requested, err := requestedIPs(service)
+		if err != nil {
+			return nil, false, err
+		}
+
 		foundAll := true
 		for _, ingress := range service.Status.LoadBalancer.Ingress {
 			addr, err := netip.ParseAddr(ingress.IP)
 			if err != nil {
 				return nil, false, err
 			}
+			if !l.cloud.config().IsPoolIP(pool, addr) {
+				klog.Infof("Existing failover IP '%s' is not part of pool '%s' for service '%s'", ingress.IP, pool, service.Name)
+				foundAll = false
+				continue
+			}
+			if !isRequestedIP(requested, addr) {
+				klog.Infof("Existing failover IP '%s' is not requested for service '%s'", ingress.IP, service.Name)
+				foundAll = false
+				continue
+			}
+			if !l.cloud.alloc.isAvailable(key, addr) {
+				klog.Infof("Existing failover IP '%s' is allocated to another service than '%s'", ingress.IP, service.Name)
+				foundAll = false
+				continue
+			}
 			if addr.Is4() {
 				needIPv4 = false
 			} else if addr.Is6() {
@@ -66,8 +148,13 @@ func (l *loadBalancers) GetLoadBalancer(ctx context.Context, clusterName string,
 
 			found := false
 			for _, ip := range resp.Return_ {
-				if *ip == ingress.IP {
+				prefix, err := parseServerIP(*ip)
+				if err != nil {
+					return nil, false, err
+				}
+				if prefix.Contains(addr) {
 					klog.Infof("Found existing failover IP '%s' on node '%s' for service '%s'", *ip, nodeName, service.Name)
+					setIPOwner(ingress.IP, nodeName)
 					found = true
 					break
 				}
@@ -94,19 +181,77 @@ func (l *loadBalancers) GetLoadBalancerName(ctx context.Context, clusterName str
 }
 
 func (l *loadBalancers) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	if err := l.cloud.initialized(); err != nil {
+		return nil, err
+	}
+	/* the service, health, drain and endpoints controllers ensure concurrently */
+	unlock := l.cloud.services.lock(serviceKey(service))
+	defer unlock()
+	status, err := l.ensureLoadBalancer(ctx, clusterName, service, nodes)
+	var assignErr *AssignmentError
+	if errors.As(err, &assignErr) {
+		l.cloud.events.Event(service, v1.EventTypeWarning, assignErr.Reason(), assignErr.Error())
+		err := l.cloud.updateServiceCondition(service, metav1.ConditionFalse, assignErr.Reason(), assignErr.Error())
+		if err != nil {
+			klog.Errorf("Failed to update condition of service '%s': %v", service.Name, err)
+		}
+	} else if err == nil {
+		err := l.cloud.updateServiceCondition(service, metav1.ConditionTrue, serviceConditionAssigned, "Failover IP assigned")
+		if err != nil {
+			klog.Errorf("Failed to update condition of service '%s': %v", service.Name, err)
+		}
+	}
+	return status, err
+}
+
+func (l *loadBalancers) ensureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	config := l.cloud.config()
 	readyNodes := make(map[string]*v1.Node)
 	for _, node := range nodes {
-		for _, cond := range node.Status.Conditions {
-			if cond.Type == v1.NodeReady && cond.Status == v1.ConditionTrue {
-				readyNodes[node.Name] = node
-				break
-			}
+		if config.Nodes.isEligible(node) && !l.cloud.unhealthy.contains(node.Name) {
+			readyNodes[node.Name] = node
 		}
 	}
 
+	err := l.cloud.alloc.sync(ctx, l.cloud.client)
+	if err != nil {
+		return nil, err
+	}
+
+	key := serviceKey(service)
+	pool := service.Annotations[servicePool]
+	prefixes, err := config.PoolPrefixes(pool)
+	if err != nil {
+		return nil, err
+	}
+	requested, err := requestedIPs(service)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range requested {
+		if !config.IsFailoverIP(addr) {
+			return nil, fmt.Errorf("requested IP '%s' for service '%s' is not a managed failover IP", addr, service.Name)
+		}
+		if !config.IsPoolIP(pool, addr) {
+			return nil, fmt.Errorf("requested IP '%s' for service '%s' is not part of pool '%s'", addr, service.Name, pool)
+		}
+		if !l.cloud.alloc.isAvailable(key, addr) {
+			return nil, fmt.Errorf("requested IP '%s' for service '%s' is already allocated", addr, service.Name)
+		}
+	}
+
+	eligible := make([]*v1.Node, 0, len(readyNodes))
+	for _, node := range readyNodes {
+		eligible = append(eligible, node)
+	}
+	candidates, err := l.cloud.nodes.Select(ctx, service, eligible)
+	if err != nil {
+		return nil, err
+	}
+
 	klog.Infof("Checking existing loadbalancer for service '%s'", service.Name)
 	if nodeName, ok := service.Labels[serviceNode]; ok {
-		if _, ok := readyNodes[nodeName]; ok {
+		if slices.ContainsFunc(candidates, func(node *v1.Node) bool { return node.Name == nodeName }) {
 			if status, exists, err := l.GetLoadBalancer(ctx, clusterName, service); exists {
 				return status, err
 			}
@@ -124,8 +269,13 @@ func (l *loadBalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 	}
 
 	klog.Infof("Searching matching loadbalancer for service '%s'", service.Name)
-	for nodeName, node := range readyNodes {
+	for _, node := range candidates {
+		nodeName := node.Name
 		resp, err := l.cloud.getServerIPs(ctx, nodeName)
+		if errors.Is(err, ErrUnknownServer) {
+			klog.Warningf("Skipping unknown node '%s' for service '%s'", nodeName, service.Name)
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -133,15 +283,21 @@ func (l *loadBalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 		needIPv6 := wantIPv6
 		ingress := []v1.LoadBalancerIngress{}
 		for _, ip := range resp.Return_ {
-			addr, err := netip.ParseAddr(*ip)
+			prefix, err := parseServerIP(*ip)
 			if err != nil {
 				return nil, err
 			}
+			addr := prefix.Addr()
 			if (addr.Is4() && !needIPv4) || (addr.Is6() && !needIPv6) {
 				continue
 			}
-			if l.cloud.config.IsFailoverIP(addr) {
-				klog.Infof("Found matching failover IP '%s' on node '%s' for service '%s'", *ip, nodeName, service.Name)
+			if !config.IsPoolIP(pool, addr) {
+				continue
+			}
+			addr, ok := l.selectIP(key, prefix, requested)
+			if ok {
+				klog.Infof("Found matching failover IP '%s' in '%s' on node '%s' for service '%s'", addr, *ip, nodeName, service.Name)
+				setIPOwner(addr.String(), nodeName)
 				ingress = append(ingress, v1.LoadBalancerIngress{IP: addr.String()})
 				if addr.Is4() {
 					needIPv4 = false
@@ -157,44 +313,114 @@ func (l *loadBalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 	}
 
 	klog.Infof("Creating new loadbalancer for service '%s'", service.Name)
-	for nodeName, node := range readyNodes {
+	fo, ok := failoverFrom(ctx)
+	if !ok {
+		fo = failoverOf(service, nodes)
+	}
+	unusable := 0
+	refused := false
+	inUse := false
+	for _, node := range candidates {
+		nodeName := node.Name
 		resp, err := l.cloud.getServerInfo(ctx, nodeName)
+		if errors.Is(err, ErrUnknownServer) {
+			klog.Warningf("Skipping unknown node '%s' for service '%s'", nodeName, service.Name)
+			unusable++
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
 		if resp.Return_.Status == serverStateOffline {
+			unusable++
+			l.cloud.events.Eventf(node, v1.EventTypeWarning, eventReasonNodeOffline,
+				"vServer '%s' is offline and cannot receive failover IPs", nodeName)
 			continue
 		}
 		needIPv4 := wantIPv4
 		needIPv6 := wantIPv6
 		ingress := []v1.LoadBalancerIngress{}
-		for _, iface := range resp.Return_.ServerInterfaces {
-			/* identify public interface based upon existence of IPs */
-			if len(iface.Ipv4IP) > 0 && len(iface.Ipv6IP) > 0 {
-				for _, prefix := range l.cloud.config.prefixes {
-					addr := prefix.Addr()
-					if (addr.Is4() && !needIPv4) || (addr.Is6() && !needIPv6) {
-						continue
-					}
-					ip := addr.String()
-					resp, err := l.cloud.routeServerIP(ctx, ip, strconv.Itoa(prefix.Bits()), resp.Return_.VServerName, iface.Mac)
+		if iface := publicInterface(resp.Return_); iface != nil {
+			for _, prefix := range prefixes {
+				addr := prefix.Addr()
+				if (addr.Is4() && !needIPv4) || (addr.Is6() && !needIPv6) {
+					continue
+				}
+				/* other services may route the same prefix concurrently */
+				unlock := l.cloud.subnets.lock(prefix.String())
+				addr, ok := l.selectIP(key, prefix, requested)
+				if !ok {
+					unlock()
+					continue
+				}
+				routed, err := l.isRouted(ctx, nodeName, prefix)
+				if err != nil {
+					unlock()
+					return nil, err
+				}
+				/* the whole prefix is routed, so other services move along */
+				var tenants []*v1.Service
+				if !routed {
+					var movable bool
+					tenants, movable, err = l.tenants(ctx, key, addr, prefix, node, eligible)
 					if err != nil {
+						unlock()
 						return nil, err
 					}
-					if resp.Return_ {
+					if !movable {
+						klog.Infof("Skipping failover subnet '%s' on node '%s', it cannot move along for other services", prefix, nodeName)
+						inUse = true
+						unlock()
+						continue
+					}
+				}
+				fresh, err := l.cloud.alloc.claim(key, addr)
+				if err != nil {
+					klog.Infof("Skipping failover IP '%s': %v", addr, err)
+					unlock()
+					continue
+				}
+				ip := addr.String()
+				resp, err := l.cloud.routeServerIP(ctx, prefix.Addr().String(), strconv.Itoa(prefix.Bits()), resp.Return_.VServerName, iface.Mac)
+				if err != nil {
+					rerouteFailures.WithLabelValues(ip, fo.reason).Inc()
+					l.rerouteFailed(service, node, ip, err.Error())
+					if fresh {
+						l.cloud.alloc.release(key, addr)
+					}
+					unlock()
+					return nil, err
+				}
+				if !resp.Return_ {
+					rerouteFailures.WithLabelValues(ip, fo.reason).Inc()
+					l.rerouteFailed(service, node, ip, "rejected by SCP")
+					refused = true
+					if fresh {
+						l.cloud.alloc.release(key, addr)
+					}
+				}
+				if resp.Return_ {
+					if !l.cloud.dryRun(service, "would route failover IP '%s' to node '%s' (%s)", ip, nodeName, fo.reason) {
 						klog.Infof("Rerouted failover IP '%s' to node '%s' for service '%s'", ip, nodeName, service.Name)
-						ingress = append(ingress, v1.LoadBalancerIngress{IP: ip})
-						if addr.Is4() {
-							needIPv4 = false
-						} else if addr.Is6() {
-							needIPv6 = false
+						reroutes.WithLabelValues(ip, fo.reason).Inc()
+						setIPOwner(ip, nodeName)
+						l.rerouted(service, node, nodes, ip, fo.reason)
+						l.moveTenants(tenants, node, nodes, prefix, fo.reason)
+						if !fo.since.IsZero() {
+							timeToFailover.WithLabelValues(fo.reason).Observe(time.Since(fo.since).Seconds())
 						}
 					}
-					if !needIPv4 && !needIPv6 {
-						break
+					ingress = append(ingress, v1.LoadBalancerIngress{IP: ip})
+					if addr.Is4() {
+						needIPv4 = false
+					} else if addr.Is6() {
+						needIPv6 = false
 					}
 				}
-				break
+				unlock()
+				if !needIPv4 && !needIPv6 {
+					break
+				}
 			}
 		}
 		if len(ingress) > 0 {
@@ -202,7 +428,15 @@ func (l *loadBalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 			return l.createLoadBalancerStatus(service, node, ingress)
 		}
 	}
-	return nil, nil
+	assignErr := &AssignmentError{Service: service.Name, Pool: pool, kind: ErrNoFailoverIP}
+	if unusable == len(candidates) {
+		assignErr.kind = ErrNoReadyNode
+	} else if refused {
+		assignErr.kind = ErrRouteRefused
+	} else if inUse {
+		assignErr.kind = ErrSubnetInUse
+	}
+	return nil, assignErr
 }
 
 func (l *loadBalancers) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
@@ -211,19 +445,240 @@ func (l *loadBalancers) UpdateLoadBalancer(ctx context.Context, clusterName stri
 }
 
 func (l *loadBalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	if err := l.cloud.initialized(); err != nil {
+		return err
+	}
+	unlock := l.cloud.services.lock(serviceKey(service))
+	defer unlock()
 	if _, ok := service.Labels[serviceNode]; ok {
-		return l.cloud.removeServiceNode(service, false)
+		err := l.cloud.removeServiceNode(service, false)
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	l.cloud.alloc.release(serviceKey(service))
+	return l.cloud.removeServiceIPs(service)
 }
 
 func (l *loadBalancers) createLoadBalancerStatus(service *v1.Service, node *v1.Node, ingress []v1.LoadBalancerIngress) (*v1.LoadBalancerStatus, error) {
 	if _, ok := service.Labels[serviceNode]; ok {
 		l.cloud.removeServiceNode(service, false)
 	}
-	err := l.cloud.updateServiceNode(service, node)
+	addrs := make([]netip.Addr, 0, len(ingress))
+	for _, ing := range ingress {
+		addr, err := netip.ParseAddr(ing.IP)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	err := l.cloud.alloc.assign(serviceKey(service), addrs)
 	if err != nil {
 		return nil, err
 	}
+	err = l.cloud.updateServiceNode(service, node, ingress)
+	if err != nil {
+		return nil, err
+	}
+	if l.cloud.config().DryRun {
+		/* keep the current status, the service controller would patch it */
+		return service.Status.LoadBalancer.DeepCopy(), nil
+	}
 	return &v1.LoadBalancerStatus{Ingress: ingress}, nil
 }
+
+// isRouted reports whether SCP routes the prefix to the node.
+func (l *loadBalancers) isRouted(ctx context.Context, nodeName string, prefix netip.Prefix) (bool, error) {
+	resp, err := l.cloud.getServerIPs(ctx, nodeName)
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(resp.Return_, func(ip *string) bool {
+		routed, err := parseServerIP(*ip)
+		return err == nil && routed == prefix
+	}), nil
+}
+
+// tenants returns the other services with addresses in a failover subnet
+// about to be routed to the node. It reports false if the subnet must not
+// move, because the service does not own an address of it yet or the node
+// is not a candidate for one of the other services.
+func (l *loadBalancers) tenants(ctx context.Context, key string, addr netip.Addr, prefix netip.Prefix, node *v1.Node, nodes []*v1.Node) ([]*v1.Service, bool, error) {
+	keys := l.cloud.alloc.tenants(key, prefix)
+	if len(keys) == 0 {
+		return nil, true, nil
+	}
+	if !l.cloud.alloc.owns(key, addr) {
+		return nil, false, nil
+	}
+	tenants := make([]*v1.Service, 0, len(keys))
+	for _, tenant := range keys {
+		namespace, name, _ := strings.Cut(tenant, "/")
+		service, err := l.cloud.client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, false, err
+		}
+		candidates, err := l.cloud.nodes.Select(ctx, service, nodes)
+		if err != nil {
+			return nil, false, err
+		}
+		if !slices.ContainsFunc(candidates, func(candidate *v1.Node) bool { return candidate.Name == node.Name }) {
+			klog.Infof("Node '%s' is not a candidate for service '%s' sharing failover subnet '%s'", node.Name, tenant, prefix)
+			return nil, false, nil
+		}
+		tenants = append(tenants, service)
+	}
+	return tenants, true, nil
+}
+
+// moveTenants records the node a shared failover subnet was routed to on
+// the other services with addresses in it.
+func (l *loadBalancers) moveTenants(tenants []*v1.Service, node *v1.Node, nodes []*v1.Node, prefix netip.Prefix, reason string) {
+	for _, tenant := range tenants {
+		if tenant.Labels[serviceNode] == node.Name {
+			continue
+		}
+		addrs, err := allocatedIPs(tenant)
+		if err != nil {
+			klog.Errorf("Failed to move service '%s' along to node '%s': %v", serviceKey(tenant), node.Name, err)
+			continue
+		}
+		ingress := make([]v1.LoadBalancerIngress, 0, len(addrs))
+		for _, addr := range addrs {
+			ip := addr.String()
+			ingress = append(ingress, v1.LoadBalancerIngress{IP: ip})
+			if !prefix.Contains(addr) {
+				continue
+			}
+			klog.Infof("Rerouted failover IP '%s' along to node '%s' for service '%s'", ip, node.Name, tenant.Name)
+			reroutes.WithLabelValues(ip, reason).Inc()
+			setIPOwner(ip, node.Name)
+			l.rerouted(tenant, node, nodes, ip, reason)
+		}
+		if _, ok := tenant.Labels[serviceNode]; ok {
+			l.cloud.removeServiceNode(tenant, false)
+		}
+		err = l.cloud.updateServiceNode(tenant, node, ingress)
+		if err != nil {
+			klog.Errorf("Failed to move service '%s' along to node '%s': %v", serviceKey(tenant), node.Name, err)
+		}
+	}
+}
+
+// rerouted emits Events about a successful reroute on the service and on
+// the nodes the failover IP moved between.
+func (l *loadBalancers) rerouted(service *v1.Service, node *v1.Node, nodes []*v1.Node, ip, reason string) {
+	events := l.cloud.events
+	previous, ok := service.Labels[serviceNode]
+	if !ok || previous == node.Name {
+		events.Eventf(service, v1.EventTypeNormal, eventReasonRerouted,
+			"Routed failover IP '%s' to node '%s' (%s)", ip, node.Name, reason)
+		events.Eventf(node, v1.EventTypeNormal, eventReasonRerouted,
+			"Received failover IP '%s' of service '%s/%s'", ip, service.Namespace, service.Name)
+		return
+	}
+	events.Eventf(service, v1.EventTypeNormal, eventReasonRerouted,
+		"Rerouted failover IP '%s' from node '%s' to node '%s' (%s)", ip, previous, node.Name, reason)
+	events.Eventf(node, v1.EventTypeNormal, eventReasonRerouted,
+		"Received failover IP '%s' of service '%s/%s' from node '%s'", ip, service.Namespace, service.Name, previous)
+	events.Eventf(nodeObject(previous, nodes), v1.EventTypeNormal, eventReasonRerouted,
+		"Lost failover IP '%s' of service '%s/%s' to node '%s'", ip, service.Namespace, service.Name, node.Name)
+}
+
+func (l *loadBalancers) rerouteFailed(service *v1.Service, node *v1.Node, ip, message string) {
+	l.cloud.events.Eventf(service, v1.EventTypeWarning, eventReasonRerouteFailed,
+		"Failed to route failover IP '%s' to node '%s': %s", ip, node.Name, message)
+	l.cloud.events.Eventf(node, v1.EventTypeWarning, eventReasonRerouteFailed,
+		"Failed to route failover IP '%s' of service '%s/%s': %s", ip, service.Namespace, service.Name, message)
+}
+
+// failoverOf determines why a service without a usable loadbalancer needs
+// to be rerouted, and since when in case its previous node is not ready.
+func failoverOf(service *v1.Service, nodes []*v1.Node) failover {
+	nodeName, ok := service.Labels[serviceNode]
+	if !ok {
+		return failover{reason: rerouteReasonNew}
+	}
+	for _, node := range nodes {
+		if node.Name != nodeName {
+			continue
+		}
+		for _, cond := range node.Status.Conditions {
+			if cond.Type == v1.NodeReady && cond.Status != v1.ConditionTrue {
+				return failover{reason: rerouteReasonNotReady, since: cond.LastTransitionTime.Time}
+			}
+		}
+	}
+	return failover{reason: rerouteReasonIneligible}
+}
+
+// publicInterface returns the interface failover IPs are routed to.
+func publicInterface(info *scp.VServerInformationObject) *scp.ServerInterface {
+	for _, iface := range info.ServerInterfaces {
+		/* identify public interface based upon existence of IPs */
+		if len(iface.Ipv4IP) > 0 && len(iface.Ipv6IP) > 0 {
+			return iface
+		}
+	}
+	return nil
+}
+
+// selectIP returns the address of a routed prefix to use for a service. It
+// is either the requested address of the same family or the first address
+// available to the service, so that one prefix can serve several services.
+func (l *loadBalancers) selectIP(key string, prefix netip.Prefix, requested []netip.Addr) (netip.Addr, bool) {
+	if index := slices.IndexFunc(requested, prefix.Contains); index >= 0 {
+		addr := requested[index]
+		return addr, l.cloud.alloc.isAvailable(key, addr)
+	}
+	if !isRequestedIP(requested, prefix.Addr()) {
+		return netip.Addr{}, false
+	}
+	return l.cloud.alloc.next(key, prefix)
+}
+
+// parseServerIP parses an IP as returned by SCP, which is either a single
+// address or a routed subnet in CIDR notation.
+func parseServerIP(ip string) (netip.Prefix, error) {
+	if strings.ContainsRune(ip, '/') {
+		prefix, err := netip.ParsePrefix(ip)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// requestedIPs returns the failover IPs explicitly requested for a service,
+// either via annotation or via the deprecated spec.loadBalancerIP field.
+func requestedIPs(service *v1.Service) ([]netip.Addr, error) {
+	value, ok := service.Annotations[serviceIPs]
+	if !ok {
+		value = service.Spec.LoadBalancerIP
+	}
+	if value == "" {
+		return nil, nil
+	}
+	requested := []netip.Addr{}
+	for ip := range strings.SplitSeq(value, ",") {
+		addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+		if err != nil {
+			return nil, fmt.Errorf("invalid requested IP for service '%s': %w", service.Name, err)
+		}
+		requested = append(requested, addr)
+	}
+	return requested, nil
+}
+
+// isRequestedIP reports whether the address may be used, which is the case
+// if it was requested or if no IP of the same family was requested at all.
+func isRequestedIP(requested []netip.Addr, addr netip.Addr) bool {
+	if slices.Contains(requested, addr) {
+		return true
+	}
+	return !slices.ContainsFunc(requested, func(req netip.Addr) bool {
+		return req.Is4() == addr.Is4()
+	})
+}
@@ -0,0 +1,412 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func ensureTestLoadBalancer(t *testing.T, cloud *cloud, name string, annotations map[string]string) (*v1.LoadBalancerStatus, error) {
+	t.Helper()
+	service := newTestService(name, annotations)
+	_, err := cloud.client.CoreV1().Services("default").Create(context.Background(), service, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []*v1.Node{}
+	for _, name := range []string{"node-a", "node-b"} {
+		node, err := cloud.client.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	return newLoadBalancers(cloud).EnsureLoadBalancer(context.Background(), "", service, nodes)
+}
+
+// reensureTestLoadBalancer ensures the loadbalancer of an existing service
+// again, after the nodes may have changed.
+func reensureTestLoadBalancer(t *testing.T, cloud *cloud, name string) (*v1.LoadBalancerStatus, error) {
+	t.Helper()
+	ctx := context.Background()
+	service, err := cloud.client.CoreV1().Services("default").Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := cloud.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := []*v1.Node{}
+	for i := range nodes.Items {
+		candidates = append(candidates, &nodes.Items[i])
+	}
+	return newLoadBalancers(cloud).EnsureLoadBalancer(ctx, "", service, candidates)
+}
+
+// cordonTestNode marks a node unschedulable, which makes it ineligible.
+func cordonTestNode(t *testing.T, cloud *cloud, name string) {
+	t.Helper()
+	ctx := context.Background()
+	node, err := cloud.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Spec.Unschedulable = true
+	_, err = cloud.client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertIngress(t *testing.T, status *v1.LoadBalancerStatus, ip string) {
+	t.Helper()
+	if status == nil || len(status.Ingress) != 1 || status.Ingress[0].IP != ip {
+		t.Fatalf("unexpected loadbalancer status: %v, want %s", status, ip)
+	}
+}
+
+func TestEnsureLoadBalancerReroutes(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, server := newTestCloud(t, Config{Failover: []string{prefix.String()}},
+		newTestNode("node-a", true), newTestNode("node-b", false))
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.10")
+	if owner := server.Owner(prefix); owner != "node-a" {
+		t.Errorf("failover IP routed to '%s', want 'node-a'", owner)
+	}
+
+	service, err := cloud.client.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Labels[serviceNode] != "node-a" {
+		t.Errorf("service labelled with node '%s', want 'node-a'", service.Labels[serviceNode])
+	}
+	node, err := cloud.client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Labels[nodeService+"web"] != "true" {
+		t.Error("node not labelled with service")
+	}
+
+	events := cloud.events.(*record.FakeRecorder).Events
+	if event := <-events; !strings.HasPrefix(event, "Normal Rerouted") {
+		t.Errorf("unexpected event: %s", event)
+	}
+}
+
+func TestEnsureLoadBalancerFindsRoutedIP(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, server := newTestCloud(t, Config{Failover: []string{prefix.String()}},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+	server.Route(prefix, "node-b")
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.10")
+	if calls := server.Calls("changeIPRouting"); calls != 0 {
+		t.Errorf("unexpected %d calls to changeIPRouting", calls)
+	}
+}
+
+func TestEnsureLoadBalancerAllocatesOnce(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, _ := newTestCloud(t, Config{Failover: []string{prefix.String()}},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.10")
+
+	status, err = ensureTestLoadBalancer(t, cloud, "api", nil)
+	if !errors.Is(err, ErrNoFailoverIP) {
+		t.Errorf("expected no failover IP error, got: %v", err)
+	}
+	if status != nil {
+		t.Errorf("failover IP assigned twice: %v", status)
+	}
+
+	service, err := cloud.client.CoreV1().Services("default").Get(context.Background(), "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cond := meta.FindStatusCondition(service.Status.Conditions, serviceCondition)
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != eventReasonNoFailoverIPAvailable {
+		t.Errorf("unexpected service condition: %v", cond)
+	}
+}
+
+func TestEnsureLoadBalancerSubnet(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.8/29")
+	cloud, server := newTestCloud(t, Config{Failover: []string{prefix.String()}},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.8")
+
+	status, err = ensureTestLoadBalancer(t, cloud, "api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.9")
+	if calls := server.Calls("changeIPRouting"); calls != 1 {
+		t.Errorf("subnet routed %d times, want once", calls)
+	}
+}
+
+func TestEnsureLoadBalancerSharedSubnet(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.8/29")
+	nodeA := newTestNode("node-a", true)
+	nodeA.Labels = map[string]string{"zone": "a"}
+	nodeB := newTestNode("node-b", true)
+	nodeB.Labels = map[string]string{"zone": "b"}
+	cloud, server := newTestCloud(t, Config{Failover: []string{prefix.String()}}, nodeA, nodeB)
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", map[string]string{serviceNodeSelector: "zone=a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.8")
+
+	_, err = ensureTestLoadBalancer(t, cloud, "api", map[string]string{serviceNodeSelector: "zone=b"})
+	if !errors.Is(err, ErrSubnetInUse) {
+		t.Errorf("expected subnet in use error, got: %v", err)
+	}
+	if owner := server.Owner(prefix); owner != "node-a" {
+		t.Errorf("subnet moved to '%s' away from service 'web'", owner)
+	}
+
+	/* an existing service must not take the subnet away either */
+	status, err = ensureTestLoadBalancer(t, cloud, "mobile", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.9")
+	cordonTestNode(t, cloud, "node-a")
+	_, err = reensureTestLoadBalancer(t, cloud, "mobile")
+	if !errors.Is(err, ErrSubnetInUse) {
+		t.Errorf("expected subnet in use error, got: %v", err)
+	}
+	if owner := server.Owner(prefix); owner != "node-a" {
+		t.Errorf("subnet moved to '%s' away from service 'web'", owner)
+	}
+}
+
+func TestEnsureLoadBalancerMovesSharedSubnet(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.8/29")
+	cloud, server := newTestCloud(t, Config{Failover: []string{prefix.String()}},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+	ctx := context.Background()
+
+	for _, name := range []string{"web", "api"} {
+		_, err := ensureTestLoadBalancer(t, cloud, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if owner := server.Owner(prefix); owner != "node-a" {
+		t.Fatalf("subnet routed to '%s', want 'node-a'", owner)
+	}
+
+	cordonTestNode(t, cloud, "node-a")
+	status, err := reensureTestLoadBalancer(t, cloud, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.8")
+	if owner := server.Owner(prefix); owner != "node-b" {
+		t.Errorf("subnet routed to '%s', want 'node-b'", owner)
+	}
+	service, err := cloud.client.CoreV1().Services("default").Get(ctx, "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Labels[serviceNode] != "node-b" {
+		t.Errorf("service 'api' sharing the subnet labelled with node '%s', want 'node-b'", service.Labels[serviceNode])
+	}
+	node, err := cloud.client.CoreV1().Nodes().Get(ctx, "node-b", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Labels[nodeService+"api"] != "true" {
+		t.Error("node 'node-b' not labelled with service 'api'")
+	}
+}
+
+func TestEnsureLoadBalancerConcurrent(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.8/29")
+	cloud, server := newTestCloud(t, Config{Failover: []string{prefix.String()}},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+	ctx := context.Background()
+	nodes := []*v1.Node{}
+	for _, name := range []string{"node-a", "node-b"} {
+		node, err := cloud.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	/* like the service, health, drain and endpoints controllers would */
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for _, name := range []string{"web", "api"} {
+		service, err := cloud.client.CoreV1().Services("default").Create(ctx, newTestService(name, nil), metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := newLoadBalancers(cloud).EnsureLoadBalancer(ctx, "", service.DeepCopy(), nodes)
+				errs <- err
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if owner := server.Owner(prefix); owner != "node-a" {
+		t.Errorf("subnet routed to '%s', want 'node-a'", owner)
+	}
+}
+
+func TestEnsureLoadBalancerRequestedIP(t *testing.T) {
+	cloud, server := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32", "203.0.113.11/32"}},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", map[string]string{serviceIPs: "203.0.113.11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.11")
+	if owner := server.Owner(netip.MustParsePrefix("203.0.113.10/32")); owner != "" {
+		t.Errorf("unrequested failover IP routed to '%s'", owner)
+	}
+
+	_, err = ensureTestLoadBalancer(t, cloud, "api", map[string]string{serviceIPs: "198.51.100.1"})
+	if err == nil {
+		t.Error("expected error for unmanaged requested IP")
+	}
+}
+
+func TestEnsureLoadBalancerPool(t *testing.T) {
+	cloud, _ := newTestCloud(t, Config{
+		Failover: []string{"203.0.113.10/32"},
+		Pools:    map[string][]string{"public-web": {"203.0.113.20/32"}},
+	}, newTestNode("node-a", true), newTestNode("node-b", true))
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", map[string]string{servicePool: "public-web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.20")
+
+	status, err = ensureTestLoadBalancer(t, cloud, "api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.10")
+
+	_, err = ensureTestLoadBalancer(t, cloud, "other", map[string]string{servicePool: "unknown"})
+	if err == nil {
+		t.Error("expected error for unknown pool")
+	}
+}
+
+func TestEnsureLoadBalancerDeleted(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, _ := newTestCloud(t, Config{Failover: []string{prefix.String()}},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+	lb := newLoadBalancers(cloud)
+
+	_, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := cloud.client.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lb.EnsureLoadBalancerDeleted(context.Background(), "", service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := ensureTestLoadBalancer(t, cloud, "api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.10")
+}
+
+func TestEnsureLoadBalancerDryRun(t *testing.T) {
+	prefix := netip.MustParsePrefix("203.0.113.10/32")
+	cloud, server := newTestCloud(t, Config{Failover: []string{prefix.String()}, DryRun: true},
+		newTestNode("node-a", true), newTestNode("node-b", true))
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == nil || len(status.Ingress) != 0 {
+		t.Errorf("unexpected loadbalancer status: %v", status)
+	}
+	if calls := server.Calls("changeIPRouting"); calls != 0 {
+		t.Errorf("unexpected %d calls to changeIPRouting", calls)
+	}
+
+	service, err := cloud.client.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := service.Labels[serviceNode]; ok {
+		t.Error("service labelled in dry-run mode")
+	}
+	events := cloud.events.(*record.FakeRecorder).Events
+	if event := <-events; !strings.HasPrefix(event, "Normal DryRun") {
+		t.Errorf("unexpected event: %s", event)
+	}
+}
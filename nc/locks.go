@@ -0,0 +1,58 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import "sync"
+
+// keyedMutex serializes work on the same key, like a service or a failover
+// subnet, while work on other keys proceeds concurrently. The zero value
+// is ready to use.
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the key and returns the function unlocking it again.
+func (k *keyedMutex) lock(key string) func() {
+	k.mutex.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		k.mutex.Lock()
+		defer k.mutex.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	metricsSubsystem = "nc_failover"
+
+	rerouteReasonNew        = "new"
+	rerouteReasonNotReady   = "node_not_ready"
+	rerouteReasonIneligible = "node_ineligible"
+	rerouteReasonUnhealthy  = "node_unhealthy"
+	rerouteReasonEndpoints  = "endpoints_moved"
+	rerouteReasonDrift      = "drift"
+)
+
+var (
+	scpRequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "scp_request_duration_seconds",
+			Help:           "Latency of SCP SOAP requests by operation.",
+			Buckets:        metrics.ExponentialBuckets(0.05, 2, 10),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+	scpRequestErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "scp_request_errors_total",
+			Help:           "Number of failed SCP SOAP requests by operation and error kind.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation", "kind"},
+	)
+	reroutes = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "reroutes_total",
+			Help:           "Number of successful failover IP reroutes by IP and reason.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"ip", "reason"},
+	)
+	rerouteFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "reroute_failures_total",
+			Help:           "Number of failed failover IP reroutes by IP and reason.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"ip", "reason"},
+	)
+	ipOwner = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "ip_owner",
+			Help:           "Node currently owning a failover IP, always 1.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"ip", "node"},
+	)
+	timeToFailover = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "time_to_failover_seconds",
+			Help:           "Time from detecting a failed node until its failover IP was rerouted.",
+			Buckets:        metrics.ExponentialBuckets(1, 2, 10),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+
+	scpCredentialsValid = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "scp_credentials_valid",
+			Help:           "Whether SCP accepted the credentials of an account on the last check.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"account"},
+	)
+
+	ipOwnersMutex sync.Mutex
+	ipOwners      = make(map[string]string)
+)
+
+func init() {
+	legacyregistry.MustRegister(scpRequestDuration, scpRequestErrors,
+		reroutes, rerouteFailures, ipOwner, timeToFailover, scpCredentialsValid)
+}
+
+// setIPOwner records the node a failover IP is routed to.
+func setIPOwner(ip, node string) {
+	ipOwnersMutex.Lock()
+	defer ipOwnersMutex.Unlock()
+	if previous, ok := ipOwners[ip]; ok {
+		if previous == node {
+			return
+		}
+		ipOwner.Delete(map[string]string{"ip": ip, "node": previous})
+	}
+	ipOwners[ip] = node
+	ipOwner.WithLabelValues(ip, node).Set(1)
+}
+
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrAuthentication):
+		return "authentication"
+	case errors.Is(err, ErrUnknownServer):
+		return "unknown_server"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	}
+	var transport *TransportError
+	if errors.As(err, &transport) {
+		return "transport"
+	}
+	return "fault"
+}
+
+type failoverKey struct{}
+
+// failover describes why and since when a service needs to be rerouted.
+type failover struct {
+	reason string
+	since  time.Time
+}
+
+// withFailover annotates the context of a reconciliation triggered by a
+// controller detecting a failure, for the reroute metrics.
+func withFailover(ctx context.Context, reason string, since time.Time) context.Context {
+	return context.WithValue(ctx, failoverKey{}, failover{reason, since})
+}
+
+func failoverFrom(ctx context.Context) (failover, bool) {
+	f, ok := ctx.Value(failoverKey{}).(failover)
+	return f, ok
+}
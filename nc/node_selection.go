@@ -0,0 +1,217 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	nodePolicyPreferLabel = "prefer-label"
+	nodePolicyEndpoints   = "endpoints"
+	nodePolicySpread      = "spread"
+)
+
+type NodeSelectionConfig struct {
+	Policies          []string `yaml:"policies"`
+	PreferLabel       string   `yaml:"preferLabel"`
+	ExcludeTaints     []string `yaml:"excludeTaints"`
+	Selector          string   `yaml:"selector"`
+	AllowControlPlane bool     `yaml:"allowControlPlane"`
+	selector          labels.Selector
+}
+
+func (n *NodeSelectionConfig) Initialize(path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	/* an empty list disables excluding tainted nodes */
+	if n.ExcludeTaints == nil {
+		n.ExcludeTaints = []string{v1.LabelNodeExcludeBalancers}
+	}
+	policies := []string{nodePolicyPreferLabel, nodePolicyEndpoints, nodePolicySpread}
+	for i, policy := range n.Policies {
+		if !slices.Contains(policies, policy) {
+			errs = append(errs, field.NotSupported(path.Child("policies").Index(i), policy, policies))
+		}
+	}
+	if _, err := labels.Parse(n.PreferLabel); err != nil {
+		errs = append(errs, field.Invalid(path.Child("preferLabel"), n.PreferLabel, err.Error()))
+	}
+	selector, err := labels.Parse(n.Selector)
+	if err != nil {
+		errs = append(errs, field.Invalid(path.Child("selector"), n.Selector, err.Error()))
+	}
+	n.selector = selector
+	return errs
+}
+
+// nodeSelector orders the candidate nodes for a new failover route by
+// preference and drops the nodes a service must not be routed to.
+type nodeSelector interface {
+	Select(ctx context.Context, service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error)
+}
+
+// newNodeSelector chains the configured policies, the first one taking
+// precedence. Node affinity from the service annotation and restriction to
+// local endpoints always apply.
+func newNodeSelector(config *NodeSelectionConfig, client kubernetes.Interface) (nodeSelector, error) {
+	chain := chainSelector{affinitySelector{}, localSelector{client}}
+	for _, policy := range config.Policies {
+		switch policy {
+		case nodePolicyPreferLabel:
+			selector, err := labels.Parse(config.PreferLabel)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, preferLabelSelector{selector})
+		case nodePolicyEndpoints:
+			chain = append(chain, endpointsSelector{client})
+		case nodePolicySpread:
+			chain = append(chain, spreadSelector{})
+		default:
+			return nil, fmt.Errorf("unknown node selection policy: %s", policy)
+		}
+	}
+	return chain, nil
+}
+
+type chainSelector []nodeSelector
+
+func (c chainSelector) Select(ctx context.Context, service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	nodes = slices.Clone(nodes)
+	slices.SortFunc(nodes, func(a, b *v1.Node) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	/* apply in reverse, each stable sort keeps the order of the later ones */
+	for i := len(c) - 1; i >= 0; i-- {
+		var err error
+		nodes, err = c[i].Select(ctx, service, nodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// affinitySelector restricts the nodes to those matching the label
+// selector given in the service annotation.
+type affinitySelector struct{}
+
+func (affinitySelector) Select(ctx context.Context, service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	value, ok := service.Annotations[serviceNodeSelector]
+	if !ok {
+		return nodes, nil
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node selector for service '%s': %w", service.Name, err)
+	}
+	return slices.DeleteFunc(nodes, func(node *v1.Node) bool {
+		return !selector.Matches(labels.Set(node.Labels))
+	}), nil
+}
+
+// preferLabelSelector prefers nodes matching the configured label selector.
+type preferLabelSelector struct {
+	selector labels.Selector
+}
+
+func (p preferLabelSelector) Select(ctx context.Context, service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	return preferNodes(nodes, func(node *v1.Node) bool {
+		return p.selector.Matches(labels.Set(node.Labels))
+	}), nil
+}
+
+// endpointsSelector prefers nodes running ready endpoints of the service.
+type endpointsSelector struct {
+	client kubernetes.Interface
+}
+
+func (e endpointsSelector) Select(ctx context.Context, service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	endpoints, err := endpointNodes(ctx, e.client, service)
+	if err != nil {
+		return nil, err
+	}
+	return preferNodes(nodes, func(node *v1.Node) bool {
+		return endpoints[node.Name]
+	}), nil
+}
+
+// spreadSelector prefers nodes carrying the fewest failover services.
+type spreadSelector struct{}
+
+func (spreadSelector) Select(ctx context.Context, service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	count := func(node *v1.Node) int {
+		services := 0
+		for label, value := range node.Labels {
+			if strings.HasPrefix(label, nodeService) && value == "true" {
+				services++
+			}
+		}
+		return services
+	}
+	slices.SortStableFunc(nodes, func(a, b *v1.Node) int {
+		return count(a) - count(b)
+	})
+	return nodes, nil
+}
+
+func preferNodes(nodes []*v1.Node, prefer func(*v1.Node) bool) []*v1.Node {
+	slices.SortStableFunc(nodes, func(a, b *v1.Node) int {
+		switch {
+		case prefer(a) && !prefer(b):
+			return -1
+		case !prefer(a) && prefer(b):
+			return 1
+		}
+		return 0
+	})
+	return nodes
+}
+
+// endpointNodes returns the names of the nodes running ready endpoints of
+// the service according to its EndpointSlices.
+func endpointNodes(ctx context.Context, client kubernetes.Interface, service *v1.Service) (map[string]bool, error) {
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: service.Name})
+	opts := metav1.ListOptions{LabelSelector: selector.String()}
+	endpointSlices, err := client.DiscoveryV1().EndpointSlices(service.Namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]bool)
+	for _, slice := range endpointSlices.Items {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.NodeName == nil {
+				continue
+			}
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			nodes[*endpoint.NodeName] = true
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"maps"
+	"net/http"
+
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/cloud-provider/app"
+	"k8s.io/cloud-provider/app/config"
+	genericcontrollermanager "k8s.io/controller-manager/app"
+	"k8s.io/controller-manager/controller"
+	"k8s.io/controller-manager/pkg/healthz"
+)
+
+const readinessControllerName = "nc-failover-readiness"
+
+// InitFuncConstructors returns the given controllers with additional ones
+// reporting through /healthz whether the cloud provider is initialized and
+// whether SCP still accepts the credentials.
+func InitFuncConstructors(constructors map[string]app.ControllerInitFuncConstructor) map[string]app.ControllerInitFuncConstructor {
+	constructors = maps.Clone(constructors)
+	constructors[readinessControllerName] = app.ControllerInitFuncConstructor{
+		Constructor: func(initContext app.ControllerInitContext, completedConfig *config.CompletedConfig, provider cloudprovider.Interface) app.InitFunc {
+			return func(ctx context.Context, controllerContext genericcontrollermanager.ControllerContext) (controller.Interface, bool, error) {
+				c, ok := provider.(*cloud)
+				if !ok {
+					return nil, false, nil
+				}
+				return &readinessController{c}, true, nil
+			}
+		},
+	}
+	constructors[credentialsControllerName] = app.ControllerInitFuncConstructor{
+		Constructor: func(initContext app.ControllerInitContext, completedConfig *config.CompletedConfig, provider cloudprovider.Interface) app.InitFunc {
+			return func(ctx context.Context, controllerContext genericcontrollermanager.ControllerContext) (controller.Interface, bool, error) {
+				c, ok := provider.(*cloud)
+				if !ok {
+					return nil, false, nil
+				}
+				return c.logins, true, nil
+			}
+		},
+	}
+	return constructors
+}
+
+type readinessController struct {
+	cloud *cloud
+}
+
+func (r *readinessController) Name() string {
+	return readinessControllerName
+}
+
+func (r *readinessController) HealthChecker() healthz.UnnamedHealthChecker {
+	return r
+}
+
+func (r *readinessController) Check(req *http.Request) error {
+	return r.cloud.initialized()
+}
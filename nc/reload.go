@@ -0,0 +1,235 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	reloadKey = "config"
+
+	credentialFilesInterval = 30 * time.Second
+)
+
+// reloadController watches the ConfigMap and Secret referenced by the cloud
+// config as well as the credential files and reloads the config once one of
+// them changed.
+type reloadController struct {
+	cloud *cloud
+	queue workqueue.TypedRateLimitingInterface[string]
+	files map[string]string
+}
+
+func newReloadController(cloud *cloud) *reloadController {
+	return &reloadController{
+		cloud: cloud,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "nc-failover-reload"},
+		),
+	}
+}
+
+func (r *reloadController) Run(ctx context.Context) {
+	defer r.queue.ShutDown()
+
+	config := r.cloud.config()
+	synced := []cache.InformerSynced{}
+	if !config.Config.IsZero() {
+		informer, err := r.watch(ctx, config.Config, func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Core().V1().ConfigMaps().Informer()
+		})
+		if err != nil {
+			klog.Errorf("Failed to watch config map '%s': %v", config.Config, err)
+			return
+		}
+		synced = append(synced, informer.HasSynced)
+	}
+	if !config.Secret.IsZero() {
+		informer, err := r.watch(ctx, config.Secret, func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Core().V1().Secrets().Informer()
+		})
+		if err != nil {
+			klog.Errorf("Failed to watch secret '%s': %v", config.Secret, err)
+			return
+		}
+		synced = append(synced, informer.HasSynced)
+	}
+	files := config.credentialFiles()
+	if len(synced) == 0 && len(files) == 0 {
+		return
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return
+	}
+
+	klog.Infof("Starting reload controller")
+	go wait.UntilWithContext(ctx, r.worker, time.Second)
+	if len(files) > 0 {
+		/* projected volumes are updated by swapping symlinks, so poll */
+		r.files = readFiles(files)
+		go wait.UntilWithContext(ctx, r.pollFiles, credentialFilesInterval)
+	}
+	<-ctx.Done()
+}
+
+func (r *reloadController) pollFiles(ctx context.Context) {
+	files := readFiles(r.cloud.config().credentialFiles())
+	if !maps.Equal(files, r.files) {
+		klog.Infof("Credential files changed")
+		r.files = files
+		r.queue.Add(reloadKey)
+	}
+}
+
+func readFiles(names []string) map[string]string {
+	files := make(map[string]string, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			klog.Warningf("Failed to read credential file '%s': %v", name, err)
+			continue
+		}
+		files[name] = string(data)
+	}
+	return files
+}
+
+// watch starts an informer for the referenced object.
+func (r *reloadController) watch(ctx context.Context, ref ObjectReference, informerFor func(informers.SharedInformerFactory) cache.SharedIndexInformer) (cache.SharedIndexInformer, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(r.cloud.client, 10*time.Minute,
+		informers.WithNamespace(ref.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", ref.Name).String()
+		}),
+	)
+	informer := informerFor(factory)
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { r.queue.Add(reloadKey) },
+		UpdateFunc: func(old, obj interface{}) {
+			if old.(metav1.Object).GetResourceVersion() != obj.(metav1.Object).GetResourceVersion() {
+				r.queue.Add(reloadKey)
+			}
+		},
+		DeleteFunc: func(interface{}) { r.queue.Add(reloadKey) },
+	})
+	if err != nil {
+		return nil, err
+	}
+	factory.Start(ctx.Done())
+	return informer, nil
+}
+
+func (r *reloadController) worker(ctx context.Context) {
+	for r.processNext(ctx) {
+	}
+}
+
+func (r *reloadController) processNext(ctx context.Context) bool {
+	key, quit := r.queue.Get()
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	err := r.cloud.reload(ctx)
+	if err != nil {
+		klog.Errorf("Failed to reload cloud config, keeping the current one: %v", err)
+		r.queue.AddRateLimited(key)
+		return true
+	}
+	r.queue.Forget(key)
+	return true
+}
+
+// reload initializes a new config from the cloud config file and the
+// referenced ConfigMap and Secret, which only replaces the current config
+// if it is valid. Services with failover IPs that are no longer managed
+// are reconciled afterwards.
+func (c *cloud) reload(ctx context.Context) error {
+	config := c.base.clone()
+	err := config.Initialize(ctx, c.client)
+	if err != nil {
+		return err
+	}
+	current := c.config()
+	if config.sameState(current) {
+		return nil
+	}
+	c.current.Store(config)
+	klog.Infof("Reloaded cloud config with %d failover IPs and %d accounts", len(config.prefixes), len(config.accounts))
+
+	/* prefixes moved to another pool are no longer managed for their services */
+	removed := slices.DeleteFunc(slices.Clone(current.prefixes), func(prefix netip.Prefix) bool {
+		return slices.Contains(config.prefixes, prefix) && config.poolOf(prefix) == current.poolOf(prefix)
+	})
+	if len(removed) == 0 {
+		return nil
+	}
+	klog.Infof("Failover IPs %v are no longer managed or moved to another pool", removed)
+	return c.reconcileUnmanaged(ctx, config)
+}
+
+// reconcileUnmanaged moves services to new failover IPs whose current ones
+// are not part of their pool anymore.
+func (c *cloud) reconcileUnmanaged(ctx context.Context, config *Config) error {
+	core := c.client.CoreV1()
+	services, err := core.Services("").List(ctx, metav1.ListOptions{LabelSelector: serviceNode})
+	if err != nil {
+		return err
+	}
+	nodes, err := core.Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	candidates := make([]*v1.Node, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		candidates = append(candidates, &nodes.Items[i])
+	}
+
+	lb := newLoadBalancers(c)
+	for _, service := range services.Items {
+		pool := service.Annotations[servicePool]
+		if !slices.ContainsFunc(service.Status.LoadBalancer.Ingress, func(ingress v1.LoadBalancerIngress) bool {
+			addr, err := netip.ParseAddr(ingress.IP)
+			return err == nil && !config.IsPoolIP(pool, addr)
+		}) {
+			continue
+		}
+		klog.Infof("Moving service '%s' away from unmanaged failover IPs", serviceKey(&service))
+		_, err := lb.EnsureLoadBalancer(ctx, "", &service, candidates)
+		if err != nil {
+			klog.Errorf("Failed to move service '%s' away from unmanaged failover IPs: %v", serviceKey(&service), err)
+		}
+	}
+	return nil
+}
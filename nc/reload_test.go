@@ -0,0 +1,123 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCloudReload(t *testing.T) {
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "ccm", Namespace: "kube-system"},
+		Data:       map[string]string{configFailover: "203.0.113.10/32"},
+	}
+	cloud, server := newTestCloud(t, Config{Config: ObjectReference{Name: "ccm", Namespace: "kube-system"}}, configMap,
+		newTestNode("node-a", true), newTestNode("node-b", true))
+	ctx := context.Background()
+	core := cloud.client.CoreV1()
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.10")
+	service, err := core.Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.Status.LoadBalancer = *status
+	_, err = core.Services("default").UpdateStatus(ctx, service, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configMap.Data[configFailover] = "bogus"
+	_, err = core.ConfigMaps("kube-system").Update(ctx, configMap, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cloud.reload(ctx)
+	if err == nil {
+		t.Error("expected error for invalid failover IP")
+	}
+	if !cloud.config().IsFailoverIP(netip.MustParseAddr("203.0.113.10")) {
+		t.Error("invalid config replaced the current one")
+	}
+
+	configMap.Data[configFailover] = "203.0.113.20/32"
+	_, err = core.ConfigMaps("kube-system").Update(ctx, configMap, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cloud.reload(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloud.config().IsFailoverIP(netip.MustParseAddr("203.0.113.10")) {
+		t.Error("removed failover IP is still managed")
+	}
+	if owner := server.Owner(netip.MustParsePrefix("203.0.113.20/32")); owner == "" {
+		t.Error("service not moved to the new failover IP")
+	}
+}
+
+func TestCloudReloadPool(t *testing.T) {
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "ccm", Namespace: "kube-system"},
+		Data:       map[string]string{configFailover: "203.0.113.10/32"},
+	}
+	cloud, server := newTestCloud(t, Config{Config: ObjectReference{Name: "ccm", Namespace: "kube-system"}}, configMap,
+		newTestNode("node-a", true), newTestNode("node-b", true))
+	ctx := context.Background()
+	core := cloud.client.CoreV1()
+
+	status, err := ensureTestLoadBalancer(t, cloud, "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIngress(t, status, "203.0.113.10")
+	service, err := core.Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.Status.LoadBalancer = *status
+	_, err = core.Services("default").UpdateStatus(ctx, service, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configMap.Data = map[string]string{
+		configFailover:                "203.0.113.20/32",
+		configFailoverPool + "public": "203.0.113.10/32",
+	}
+	_, err = core.ConfigMaps("kube-system").Update(ctx, configMap, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cloud.reload(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := server.Owner(netip.MustParsePrefix("203.0.113.20/32")); owner == "" {
+		t.Error("service not moved away from failover IP of another pool")
+	}
+}
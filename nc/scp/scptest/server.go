@@ -0,0 +1,309 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scptest provides an in-process fake of the SCP SOAP endpoint
+// for tests and local development without a netcup account.
+package scptest
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/mback2k/nc-failover-ccm/nc/scp"
+)
+
+const (
+	StateOnline  = "online"
+	StateOffline = "offline"
+)
+
+// VServer models a vServer with its state and network interfaces. It
+// belongs to the account with the given login name, by default the one
+// passed to NewServer.
+type VServer struct {
+	Name       string
+	State      string
+	Interfaces []Interface
+	LoginName  string
+}
+
+// Interface models a network interface with its primary IPs.
+type Interface struct {
+	MAC  string
+	IPv4 []string
+	IPv6 []string
+}
+
+// Server speaks the SCP WSEndUser SOAP protocol on top of httptest.Server.
+type Server struct {
+	*httptest.Server
+
+	LoginName string
+	Password  string
+
+	mutex    sync.Mutex
+	accounts map[string]string
+	servers  map[string]*VServer
+	routes   map[netip.Prefix]string
+	calls    map[string]int
+	failures map[string]int
+}
+
+// NewServer starts a fake SCP endpoint accepting the given credentials.
+func NewServer(loginName, password string) *Server {
+	s := &Server{
+		LoginName: loginName,
+		Password:  password,
+		accounts:  map[string]string{loginName: password},
+		servers:   make(map[string]*VServer),
+		routes:    make(map[netip.Prefix]string),
+		calls:     make(map[string]int),
+		failures:  make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// AddAccount adds another account accepting the given credentials.
+func (s *Server) AddAccount(loginName, password string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.accounts[loginName] = password
+}
+
+// AddVServer adds or replaces a vServer.
+func (s *Server) AddVServer(server VServer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if server.LoginName == "" {
+		server.LoginName = s.LoginName
+	}
+	s.servers[server.Name] = &server
+}
+
+// SetState changes the state of a vServer, e.g. to StateOffline.
+func (s *Server) SetState(name, state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if server, ok := s.servers[name]; ok {
+		server.State = state
+	}
+}
+
+// Route routes a failover prefix to a vServer, like the SCP web UI would.
+func (s *Server) Route(prefix netip.Prefix, name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.routes[prefix.Masked()] = name
+}
+
+// Owner returns the vServer a failover prefix is routed to.
+func (s *Server) Owner(prefix netip.Prefix) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.routes[prefix.Masked()]
+}
+
+// Calls returns how often the given operation, e.g. "changeIPRouting",
+// has been called.
+func (s *Server) Calls(operation string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls[operation]
+}
+
+// Fail makes the next count calls of the given operation fail with HTTP
+// status 503 Service Unavailable, like an overloaded SCP would.
+func (s *Server) Fail(operation string, count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[operation] = count
+}
+
+type envelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    struct {
+		Request request `xml:",any"`
+	} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+}
+
+type request struct {
+	XMLName                 xml.Name
+	LoginName               string `xml:"loginName"`
+	Password                string `xml:"password"`
+	VserverName             string `xml:"vserverName"`
+	Vservername             string `xml:"vservername"`
+	RoutedIP                string `xml:"routedIP"`
+	RoutedMask              string `xml:"routedMask"`
+	DestinationVserverName  string `xml:"destinationVserverName"`
+	DestinationInterfaceMAC string `xml:"destinationInterfaceMAC"`
+}
+
+type fault struct {
+	XMLName xml.Name `xml:"S:Fault"`
+	Code    string   `xml:"faultcode"`
+	String  string   `xml:"faultstring"`
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	env := envelope{}
+	err := xml.NewDecoder(r.Body).Decode(&env)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	req := &env.Body.Request
+	s.calls[req.XMLName.Local]++
+	if s.failures[req.XMLName.Local] > 0 {
+		s.failures[req.XMLName.Local]--
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	resp, err := s.dispatch(req)
+	if err != nil {
+		resp = &fault{Code: "S:Server", String: err.Error()}
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	out, err := xml.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	fmt.Fprintf(w, `<?xml version="1.0" ?><S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/"><S:Body>%s</S:Body></S:Envelope>`, out)
+}
+
+func (s *Server) dispatch(req *request) (any, error) {
+	if password, ok := s.accounts[req.LoginName]; !ok || req.Password != password {
+		return nil, errors.New(scp.FaultValidationError)
+	}
+	switch req.XMLName.Local {
+	case "getUserData":
+		return &scp.GetUserDataResponse{Return_: &scp.UserDataObject{Loginname: req.LoginName}}, nil
+	case "getVServers":
+		names := make([]string, 0, len(s.servers))
+		for name, server := range s.servers {
+			if server.LoginName == req.LoginName {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		resp := &scp.GetVServersResponse{}
+		for _, name := range names {
+			resp.Return_ = append(resp.Return_, &name)
+		}
+		return resp, nil
+	case "getVServerState":
+		server, err := s.lookup(req.LoginName, req.VserverName)
+		if err != nil {
+			return nil, err
+		}
+		return &scp.GetVServerStateResponse{Return_: server.State}, nil
+	case "getVServerIPs":
+		server, err := s.lookup(req.LoginName, req.VserverName)
+		if err != nil {
+			return nil, err
+		}
+		return &scp.GetVServerIPsResponse{Return_: s.ips(server)}, nil
+	case "getVServerInformation":
+		server, err := s.lookup(req.LoginName, req.Vservername)
+		if err != nil {
+			return nil, err
+		}
+		info := &scp.VServerInformationObject{
+			VServerName: server.Name,
+			Status:      server.State,
+			Ips:         s.ips(server),
+		}
+		for _, iface := range server.Interfaces {
+			serverInterface := &scp.ServerInterface{Mac: iface.MAC}
+			for _, ip := range iface.IPv4 {
+				serverInterface.Ipv4IP = append(serverInterface.Ipv4IP, &ip)
+			}
+			for _, ip := range iface.IPv6 {
+				serverInterface.Ipv6IP = append(serverInterface.Ipv6IP, &ip)
+			}
+			info.ServerInterfaces = append(info.ServerInterfaces, serverInterface)
+		}
+		return &scp.GetVServerInformationResponse{Return_: info}, nil
+	case "changeIPRouting":
+		server, err := s.lookup(req.LoginName, req.DestinationVserverName)
+		if err != nil {
+			return nil, err
+		}
+		prefix, err := netip.ParsePrefix(req.RoutedIP + "/" + req.RoutedMask)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(server.Interfaces, func(iface Interface) bool {
+			return iface.MAC == req.DestinationInterfaceMAC
+		}) {
+			return &scp.ChangeIPRoutingResponse{Return_: false}, nil
+		}
+		s.routes[prefix.Masked()] = server.Name
+		return &scp.ChangeIPRoutingResponse{Return_: true}, nil
+	}
+	return nil, fmt.Errorf("unsupported operation: %s", req.XMLName.Local)
+}
+
+func (s *Server) lookup(loginName, name string) (*VServer, error) {
+	server, ok := s.servers[name]
+	if !ok || server.LoginName != loginName {
+		return nil, errors.New(scp.FaultVServerNotFound)
+	}
+	return server, nil
+}
+
+// ips returns the primary IPs of the vServer followed by the failover
+// prefixes routed to it, the latter in CIDR notation unless single hosts.
+func (s *Server) ips(server *VServer) []*string {
+	ips := []*string{}
+	for _, iface := range server.Interfaces {
+		for _, ip := range iface.IPv4 {
+			ips = append(ips, &ip)
+		}
+		for _, ip := range iface.IPv6 {
+			ips = append(ips, &ip)
+		}
+	}
+	prefixes := []netip.Prefix{}
+	for prefix, name := range s.routes {
+		if name == server.Name {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return a.Addr().Compare(b.Addr())
+	})
+	for _, prefix := range prefixes {
+		ip := prefix.String()
+		if prefix.IsSingleIP() {
+			ip = prefix.Addr().String()
+		}
+		ips = append(ips, &ip)
+	}
+	return ips
+}
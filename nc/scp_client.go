@@ -0,0 +1,223 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hooklift/gowsdl/soap"
+	"github.com/mback2k/nc-failover-ccm/nc/scp"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+var (
+	ErrAuthentication = errors.New("SCP authentication failed")
+	ErrUnknownServer  = errors.New("SCP vServer unknown")
+	ErrRateLimited    = errors.New("SCP rate limit exceeded")
+)
+
+// FaultError is a SOAP fault returned by SCP. It unwraps to one of the
+// errors above if the fault could be classified.
+type FaultError struct {
+	Operation string
+	Code      string
+	Message   string
+	kind      error
+}
+
+func (e *FaultError) Error() string {
+	return fmt.Sprintf("SCP %s failed: %s", e.Operation, e.Message)
+}
+
+func (e *FaultError) Unwrap() error {
+	return e.kind
+}
+
+// TransportError is a failure to talk to SCP at all, e.g. a timeout.
+type TransportError struct {
+	Operation string
+	Err       error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("SCP %s failed: %v", e.Operation, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// scpClient wraps scp.WSEndUser to classify errors and to retry the
+// idempotent read operations with jittered exponential backoff.
+type scpClient struct {
+	scp.WSEndUser
+	backoff wait.Backoff
+}
+
+func newSCPClient(server scp.WSEndUser, retries int) *scpClient {
+	return &scpClient{
+		WSEndUser: server,
+		backoff: wait.Backoff{
+			Duration: 250 * time.Millisecond,
+			Factor:   2,
+			Jitter:   0.5,
+			Steps:    retries + 1,
+			Cap:      5 * time.Second,
+		},
+	}
+}
+
+func (c *scpClient) GetUserDataContext(ctx context.Context, request *scp.GetUserData) (*scp.GetUserDataResponse, error) {
+	return callSCP(ctx, c, "GetUserData", true, func() (*scp.GetUserDataResponse, error) {
+		return c.WSEndUser.GetUserDataContext(ctx, request)
+	})
+}
+
+func (c *scpClient) GetVServersContext(ctx context.Context, request *scp.GetVServers) (*scp.GetVServersResponse, error) {
+	return callSCP(ctx, c, "GetVServers", true, func() (*scp.GetVServersResponse, error) {
+		return c.WSEndUser.GetVServersContext(ctx, request)
+	})
+}
+
+func (c *scpClient) GetVServerStateContext(ctx context.Context, request *scp.GetVServerState) (*scp.GetVServerStateResponse, error) {
+	return callSCP(ctx, c, "GetVServerState", true, func() (*scp.GetVServerStateResponse, error) {
+		return c.WSEndUser.GetVServerStateContext(ctx, request)
+	})
+}
+
+func (c *scpClient) GetVServerInformationContext(ctx context.Context, request *scp.GetVServerInformation) (*scp.GetVServerInformationResponse, error) {
+	return callSCP(ctx, c, "GetVServerInformation", true, func() (*scp.GetVServerInformationResponse, error) {
+		return c.WSEndUser.GetVServerInformationContext(ctx, request)
+	})
+}
+
+func (c *scpClient) GetVServerIPsContext(ctx context.Context, request *scp.GetVServerIPs) (*scp.GetVServerIPsResponse, error) {
+	return callSCP(ctx, c, "GetVServerIPs", true, func() (*scp.GetVServerIPsResponse, error) {
+		return c.WSEndUser.GetVServerIPsContext(ctx, request)
+	})
+}
+
+func (c *scpClient) ChangeIPRoutingContext(ctx context.Context, request *scp.ChangeIPRouting) (*scp.ChangeIPRoutingResponse, error) {
+	return callSCP(ctx, c, "ChangeIPRouting", false, func() (*scp.ChangeIPRoutingResponse, error) {
+		return c.WSEndUser.ChangeIPRoutingContext(ctx, request)
+	})
+}
+
+func callSCP[T any](ctx context.Context, c *scpClient, operation string, idempotent bool, call func() (T, error)) (T, error) {
+	backoff := c.backoff
+	for {
+		start := time.Now()
+		resp, err := call()
+		scpRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		if err == nil {
+			return resp, nil
+		}
+		err = classifyError(operation, err)
+		scpRequestErrors.WithLabelValues(operation, errorKind(err)).Inc()
+		if !idempotent || !isRetriable(err) || backoff.Steps <= 1 {
+			return resp, err
+		}
+		delay := backoff.Step()
+		klog.Warningf("Retrying %s in %s: %v", operation, delay, err)
+		select {
+		case <-ctx.Done():
+			return resp, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetriable reports whether retrying might help, which is the case for
+// transport errors and rate limiting, but not for faults like bad
+// credentials or an unknown vServer.
+func isRetriable(err error) bool {
+	var transport *TransportError
+	return errors.As(err, &transport) || errors.Is(err, ErrRateLimited)
+}
+
+func classifyError(operation string, err error) error {
+	var fault *soap.SOAPFault
+	if errors.As(err, &fault) {
+		return newFaultError(operation, fault.Code, fault.String)
+	}
+	var httpErr *soap.HTTPError
+	if errors.As(err, &httpErr) {
+		/* SCP returns faults with HTTP status 500 */
+		if code, message, ok := parseFault(httpErr.ResponseBody); ok {
+			return newFaultError(operation, code, message)
+		}
+		switch httpErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return &FaultError{Operation: operation, Message: http.StatusText(httpErr.StatusCode), kind: ErrAuthentication}
+		case http.StatusTooManyRequests:
+			return &FaultError{Operation: operation, Message: http.StatusText(httpErr.StatusCode), kind: ErrRateLimited}
+		}
+	}
+	return &TransportError{Operation: operation, Err: err}
+}
+
+// faultKinds classifies the known SCP fault messages, which are matched
+// exactly apart from case. Other faults are left unclassified.
+var faultKinds = map[string]error{
+	strings.ToLower(scp.FaultValidationError): ErrAuthentication,
+	strings.ToLower(scp.FaultVServerNotFound): ErrUnknownServer,
+	strings.ToLower(scp.FaultTooManyRequests): ErrRateLimited,
+}
+
+func newFaultError(operation, code, message string) *FaultError {
+	return &FaultError{
+		Operation: operation,
+		Code:      code,
+		Message:   message,
+		kind:      faultKinds[strings.ToLower(strings.TrimSpace(message))],
+	}
+}
+
+// parseFault extracts faultcode and faultstring from a SOAP fault body.
+func parseFault(body []byte) (code, message string, ok bool) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return code, message, ok
+		}
+		start, isStart := token.(xml.StartElement)
+		if !isStart {
+			continue
+		}
+		switch start.Name.Local {
+		case "faultcode":
+			if dec.DecodeElement(&code, &start) != nil {
+				return code, message, ok
+			}
+		case "faultstring":
+			if dec.DecodeElement(&message, &start) != nil {
+				return code, message, ok
+			}
+			ok = true
+		}
+	}
+}
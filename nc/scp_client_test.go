@@ -0,0 +1,82 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSCPClientFaults(t *testing.T) {
+	cloud, server := newTestCloud(t, Config{Failover: []string{"203.0.113.10/32"}})
+
+	_, err := cloud.getServerInfo(context.Background(), "node-c")
+	if !errors.Is(err, ErrUnknownServer) {
+		t.Errorf("expected unknown server error, got: %v", err)
+	}
+	if calls := server.Calls("getVServerInformation"); calls != 1 {
+		t.Errorf("unknown server retried %d times", calls-1)
+	}
+
+	cloud.config().accounts[0].Password = "wrong"
+	_, err = cloud.getServers(context.Background())
+	if !errors.Is(err, ErrAuthentication) {
+		t.Errorf("expected authentication error, got: %v", err)
+	}
+}
+
+func TestSCPClientRetriesTransportErrors(t *testing.T) {
+	cloud, server := newTestCloud(t, Config{
+		Failover: []string{"203.0.113.10/32"},
+		Endpoint: EndpointConfig{Retries: 3},
+		Cache:    CacheConfig{TTL: -1},
+	})
+	cloud.uncached.backoff.Duration = 0
+	ctx := context.Background()
+
+	login := server.Calls("getVServers")
+	server.Fail("getVServers", 2)
+	_, err := cloud.getServers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := server.Calls("getVServers") - login; calls != 3 {
+		t.Errorf("called %d times, want 3 with 2 retries", calls)
+	}
+
+	server.Close()
+	_, err = cloud.getServers(ctx)
+	var transport *TransportError
+	if !errors.As(err, &transport) {
+		t.Errorf("expected transport error, got: %v", err)
+	}
+}
+
+func TestSCPClientFaultMessages(t *testing.T) {
+	for message, kind := range map[string]error{
+		"Validation Error":                ErrAuthentication,
+		"vServer not found":               ErrUnknownServer,
+		"Too many requests":               ErrRateLimited,
+		"unknown error, please try later": nil,
+		"Login failed for vServer":        nil,
+	} {
+		if err := newFaultError("GetVServers", "S:Server", message); err.kind != kind {
+			t.Errorf("fault '%s' classified as %v, want %v", message, err.kind, kind)
+		}
+	}
+}
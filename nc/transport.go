@@ -0,0 +1,96 @@
+/*
+Copyright 2024 Marc Hörsken
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/hooklift/gowsdl/soap"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/klog/v2"
+)
+
+type EndpointConfig struct {
+	URL           string        `yaml:"url"`
+	CAFile        string        `yaml:"caFile"`
+	Timeout       time.Duration `yaml:"timeout"`
+	Proxy         string        `yaml:"proxy"`
+	Retries       int           `yaml:"retries"`
+	CheckInterval time.Duration `yaml:"checkInterval"`
+}
+
+func (e *EndpointConfig) Initialize(path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if e.URL == "" {
+		e.URL = scpWS
+	}
+	if u, err := url.Parse(e.URL); err != nil {
+		errs = append(errs, field.Invalid(path.Child("url"), e.URL, err.Error()))
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, field.Invalid(path.Child("url"), e.URL, "scheme must be http or https"))
+	}
+	if _, err := url.Parse(e.Proxy); err != nil {
+		errs = append(errs, field.Invalid(path.Child("proxy"), e.Proxy, err.Error()))
+	}
+	if e.Timeout <= 0 {
+		e.Timeout = 30 * time.Second
+	}
+	/* negative retries disable retrying */
+	if e.Retries == 0 {
+		e.Retries = 3
+	} else if e.Retries < 0 {
+		e.Retries = 0
+	}
+	/* negative interval disables checking the credentials */
+	if e.CheckInterval == 0 {
+		e.CheckInterval = 5 * time.Minute
+	}
+	return errs
+}
+
+// newSOAPClient returns a SOAP client for the configured endpoint. Without
+// a CA file the system roots are used, without a proxy the environment.
+func (e *EndpointConfig) newSOAPClient() (*soap.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if e.Proxy != "" {
+		proxy, err := url.Parse(e.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if e.CAFile != "" {
+		pem, err := os.ReadFile(e.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in cloud endpoint CA file")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	klog.Infof("Using SCP endpoint: %s", e.URL)
+	client := &http.Client{Transport: transport, Timeout: e.Timeout}
+	return soap.NewClient(e.URL, soap.WithHTTPClient(client)), nil
+}